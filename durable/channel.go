@@ -0,0 +1,142 @@
+package durable
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/reddec/dfq"
+)
+
+// reserveTimeout is the visibility timeout used for the Reserve call backing
+// Recv. It only matters if the process dies (or Recv's consumer stalls
+// indefinitely) between a value being handed out and its batch being Acked;
+// it is kept generous so it never fires during normal operation.
+const reserveTimeout = time.Hour
+
+// Options configure a Channel.
+type Options struct {
+	// SyncEvery batches acks on the receive side: a value taken from Recv is
+	// only Acked (permanently removed from the queue) once this many values
+	// have been taken from Recv, trading redelivery-on-crash of up to
+	// SyncEvery-1 already-handed-out values for fewer Ack calls. Defaults to
+	// 1 (ack every value).
+	SyncEvery int
+}
+
+// Channel is a typed, durable channel built on top of a dfq.Queue.
+type Channel[T any] struct {
+	queue dfq.Queue
+	codec Codec
+
+	out chan T
+
+	syncEvery int
+	pending   []dfq.Message
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewChannel wraps an existing dfq.Queue as a typed channel, using codec to
+// (de)serialize values of type T. The returned Channel owns a reader
+// goroutine for the lifetime of the queue; call Close to stop it.
+func NewChannel[T any](q dfq.Queue, codec Codec, opts ...Options) *Channel[T] {
+	var o Options
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.SyncEvery <= 0 {
+		o.SyncEvery = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Channel[T]{
+		queue:     q,
+		codec:     codec,
+		out:       make(chan T),
+		syncEvery: o.SyncEvery,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go c.run(ctx)
+	return c
+}
+
+// Send encodes v and durably appends it to the underlying queue.
+func (c *Channel[T]) Send(ctx context.Context, v T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("durable: send: encode: %w", err)
+	}
+	if err := c.queue.Put(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("durable: send: %w", err)
+	}
+	return nil
+}
+
+// Recv returns the channel decoded values are delivered on. It is closed
+// once Close has stopped the reader goroutine.
+func (c *Channel[T]) Recv() <-chan T {
+	return c.out
+}
+
+// Close stops the reader goroutine and acks any values already handed to a
+// receiver but not yet acked (due to SyncEvery batching), so they are not
+// redelivered next time the queue is opened.
+func (c *Channel[T]) Close() error {
+	c.cancel()
+	<-c.done
+	for _, msg := range c.pending {
+		if err := msg.Ack(); err != nil {
+			return fmt.Errorf("durable: close: %w", err)
+		}
+	}
+	c.pending = nil
+	return nil
+}
+
+// run delivers values to Recv in order using Reserve/Ack rather than
+// Peek/Commit: Peek always returns the same head record until it is
+// committed, so batching commits on top of it would either re-deliver the
+// still-uncommitted head on every iteration or commit records that were
+// never handed out. Reserve instead advances its own read position per call,
+// so each value is read and delivered exactly once regardless of when the
+// batch is Acked.
+func (c *Channel[T]) run(ctx context.Context) {
+	defer close(c.done)
+	defer close(c.out)
+	for {
+		msg, err := c.queue.Reserve(ctx, reserveTimeout)
+		if err != nil {
+			return
+		}
+		raw, err := ioutil.ReadAll(msg)
+		_ = msg.Close()
+		if err != nil {
+			return
+		}
+		var v T
+		if err := c.codec.Unmarshal(raw, &v); err != nil {
+			return
+		}
+		select {
+		case c.out <- v:
+		case <-ctx.Done():
+			return
+		}
+		c.pending = append(c.pending, msg)
+		if len(c.pending) >= c.syncEvery {
+			for _, pending := range c.pending {
+				if err := pending.Ack(); err != nil {
+					return
+				}
+			}
+			c.pending = c.pending[:0]
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package durable
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/reddec/dfq"
+)
+
+type event struct {
+	Name  string
+	Count int
+}
+
+func TestChannel_SendRecv(t *testing.T) {
+	const dir = "./test/channel"
+	defer os.RemoveAll(dir)
+
+	q, err := dfq.Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ch := NewChannel[event](q, JSONCodec{})
+	defer ch.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := ch.Send(ctx, event{Name: "a", Count: 1}); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ch.Send(ctx, event{Name: "b", Count: 2}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case v := <-ch.Recv():
+		if v.Name != "a" || v.Count != 1 {
+			t.Errorf("unexpected value: %+v", v)
+		}
+	case <-ctx.Done():
+		t.Error("timed out waiting for first value")
+		return
+	}
+
+	select {
+	case v := <-ch.Recv():
+		if v.Name != "b" || v.Count != 2 {
+			t.Errorf("unexpected value: %+v", v)
+		}
+	case <-ctx.Done():
+		t.Error("timed out waiting for second value")
+		return
+	}
+
+	if err := ch.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 0 {
+		t.Error("queue should be fully committed after Close")
+	}
+}
+
+func TestChannel_SyncEvery(t *testing.T) {
+	const dir = "./test/channel-sync"
+	defer os.RemoveAll(dir)
+
+	q, err := dfq.Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ch := NewChannel[event](q, GobCodec{}, Options{SyncEvery: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := ch.Send(ctx, event{Name: "a", Count: 1}); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case <-ch.Recv():
+	case <-ctx.Done():
+		t.Error("timed out waiting for value")
+		return
+	}
+
+	// SyncEvery is 2: the first received value should not have been
+	// committed to the underlying queue yet.
+	if q.Len() != 1 {
+		t.Error("value should not be committed before SyncEvery is reached")
+	}
+
+	if err := ch.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 0 {
+		t.Error("Close should flush any pending uncommitted values")
+	}
+}
+
+// TestChannel_SyncEveryDeliversEachValueOnce guards against SyncEvery
+// batching re-delivering an already-handed-out value or dropping one that
+// was never delivered: every sent value must reach Recv exactly once, in
+// order, regardless of where the SyncEvery boundary falls.
+func TestChannel_SyncEveryDeliversEachValueOnce(t *testing.T) {
+	const dir = "./test/channel-sync-once"
+	defer os.RemoveAll(dir)
+
+	q, err := dfq.Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ch := NewChannel[event](q, JSONCodec{}, Options{SyncEvery: 2})
+	defer ch.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for i := 1; i <= 3; i++ {
+		if err := ch.Send(ctx, event{Name: "v", Count: i}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	var got []int
+	for i := 0; i < 3; i++ {
+		select {
+		case v := <-ch.Recv():
+			got = append(got, v.Count)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for value %d, got %v so far", i+1, got)
+		}
+	}
+
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("expected [1 2 3] delivered exactly once each, got %v", got)
+	}
+}
@@ -0,0 +1,12 @@
+// Package durable provides a generic, typed channel built on top of a
+// dfq.Queue: Send durably persists a value before returning, and Recv
+// delivers values in order, committing each one only after it has been
+// taken by the receiver.
+package durable
+
+// Codec encodes and decodes values for storage in a dfq.Queue as opaque byte
+// records. Unmarshal is handed a pointer to the destination value.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
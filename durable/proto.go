@@ -0,0 +1,31 @@
+//go:build protobuf
+
+package durable
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtoCodec encodes values using Protocol Buffers: values passed to Marshal
+// and Unmarshal must implement proto.Message. Building with this codec
+// requires the "protobuf" build tag and google.golang.org/protobuf as a
+// module dependency.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("durable: proto codec: %T does not implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("durable: proto codec: %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
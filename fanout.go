@@ -0,0 +1,302 @@
+package dfq
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cursorsDir      = "cursors"
+	cursorSuffix    = ".pos"
+	gcSweepInterval = time.Second
+)
+
+// Consumer is an independent, named read cursor over a queue, obtained via
+// queue.Subscribe. It exposes the same Peek/Commit/Wait surface as Queue, but
+// Commit only advances this consumer's own cursor: the underlying record is
+// only removed from disk once every subscriber has committed past it (see
+// Subscribe).
+type Consumer interface {
+	// Peek the oldest item this consumer has not yet committed, or ErrEmptyQueue.
+	Peek() (io.ReadCloser, error)
+	// Commit advances this consumer's cursor past the current item.
+	Commit() error
+	// Wait peeks the oldest uncommitted item, blocking until one is available or ctx is done.
+	Wait(ctx context.Context) (io.ReadCloser, error)
+}
+
+// consumer is the Consumer implementation returned by queue.Subscribe. Its
+// cursor is persisted to cursors/<name>.pos so it survives process restarts.
+type consumer struct {
+	queue *queue
+	name  string
+
+	lock      sync.Mutex
+	currentId int64
+}
+
+var _ Consumer = (*consumer)(nil)
+
+func (c *consumer) cursorPath() string {
+	return filepath.Join(c.queue.directory, cursorsDir, c.name+cursorSuffix)
+}
+
+// save persists id as the cursor via the same write-temp-then-rename pattern
+// used for the inflight and segment state files, so a crash mid-write never
+// leaves a torn cursor. It does not itself update c.currentId, so callers can
+// confirm the write succeeded before committing to the new position.
+func (c *consumer) save(id int64) error {
+	tmp := c.cursorPath() + tempSuffix
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(id, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.cursorPath())
+}
+
+// Peek the oldest record this consumer has not yet committed, or ErrEmptyQueue.
+func (c *consumer) Peek() (io.ReadCloser, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		path := filepath.Join(c.queue.directory, fmt.Sprint(c.currentId, dataSuffix))
+		payload, err := readRecord(path)
+		if err == nil {
+			return ioutil.NopCloser(bytes.NewReader(payload)), nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if c.currentId >= atomic.LoadInt64(&c.queue.writer.counter) {
+			return nil, ErrEmptyQueue
+		}
+		// A gap: either a repaired/quarantined record, or one every other
+		// subscriber (including this one, previously) has already committed
+		// and the gc has removed. Either way, skip it.
+		c.currentId++
+	}
+}
+
+// Commit advances the cursor past the current record and persists it. The
+// record itself is only deleted from disk once every subscriber has
+// committed past it; see queue.collectGarbage. If persisting fails, the
+// in-memory cursor is left unchanged so a retried Commit can't skip ahead of
+// what was actually saved.
+func (c *consumer) Commit() error {
+	c.lock.Lock()
+	next := c.currentId + 1
+	err := c.save(next)
+	if err == nil {
+		c.currentId = next
+	}
+	c.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("dfq: consumer %q: commit: %w", c.name, err)
+	}
+	c.queue.triggerGC()
+	return nil
+}
+
+// Wait peeks the oldest uncommitted record for this consumer, blocking until
+// one is available or ctx is done.
+func (c *consumer) Wait(ctx context.Context) (io.ReadCloser, error) {
+	for {
+		f, err := c.Peek()
+		if err == nil {
+			return f, nil
+		}
+		if err != ErrEmptyQueue {
+			return nil, err
+		}
+		ch := c.queue.waitChan()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+// Subscribe registers a named, independently-paced consumer over the queue.
+// The first call to Subscribe switches the queue into multi-consumer (pub-
+// sub) mode: from then on, a record is only deleted once every subscriber
+// has committed past it, via a background reference-counted gc, so direct
+// use of Queue.Peek/Commit/Reserve on the same queue should be avoided in
+// favor of Subscribe. Calling Subscribe again with a name already registered
+// returns the existing Consumer.
+//
+// MaxDepth/MaxBytes/MaxAge retention (see Options) is not subscriber-aware:
+// DropOldest and the MaxAge janitor both evict via the same single
+// reader.currentId cursor Subscribe tells callers to stop using, so they can
+// delete a record before a slower subscriber has committed past it. Don't
+// combine Subscribe with those on the same queue.
+func (q *queue) Subscribe(name string) (Consumer, error) {
+	if err := os.MkdirAll(filepath.Join(q.directory, cursorsDir), 0755); err != nil {
+		return nil, fmt.Errorf("dfq: subscribe %q: %w", name, err)
+	}
+	q.subs.lock.Lock()
+	defer q.subs.lock.Unlock()
+	if q.subs.byName == nil {
+		q.subs.byName = map[string]*consumer{}
+	}
+	if c, ok := q.subs.byName[name]; ok {
+		return c, nil
+	}
+
+	c := &consumer{queue: q, name: name}
+	raw, err := ioutil.ReadFile(c.cursorPath())
+	switch {
+	case err == nil:
+		id, perr := strconv.ParseInt(string(raw), 10, 64)
+		if perr != nil {
+			return nil, fmt.Errorf("dfq: subscribe %q: corrupt cursor: %w", name, perr)
+		}
+		c.currentId = id
+	case os.IsNotExist(err):
+		// New subscriber: start from the oldest record the gc hasn't already
+		// collected (q.gc.low once gc is running, or the oldest file still on
+		// disk for the very first subscriber, before gc has ever run), so it
+		// sees everything available rather than only future writes or an
+		// unbounded run of already-collected ids.
+		var start int64
+		if stop, _ := q.gcHandles(); stop == nil {
+			start = atomic.LoadInt64(&q.reader.currentId)
+		} else {
+			q.gc.lock.Lock()
+			start = q.gc.low
+			q.gc.lock.Unlock()
+		}
+		c.currentId = start
+		if err := c.save(start); err != nil {
+			return nil, fmt.Errorf("dfq: subscribe %q: %w", name, err)
+		}
+	default:
+		return nil, fmt.Errorf("dfq: subscribe %q: %w", name, err)
+	}
+
+	q.subs.byName[name] = c
+	q.ensureGC()
+	return c, nil
+}
+
+// Unsubscribe deregisters name and removes its persisted cursor, releasing
+// its hold on any records it had not yet committed. It is a no-op if name is
+// not currently subscribed.
+func (q *queue) Unsubscribe(name string) error {
+	q.subs.lock.Lock()
+	c, ok := q.subs.byName[name]
+	if ok {
+		delete(q.subs.byName, name)
+	}
+	q.subs.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(c.cursorPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("dfq: unsubscribe %q: %w", name, err)
+	}
+	q.triggerGC()
+	return nil
+}
+
+// ensureGC lazily starts the background gc goroutine the first time a
+// subscriber is registered; it never needs to run for a queue that has no
+// subscribers. gcInitLock guards gcTrigger/gcStop/gcDone so Destroy can check
+// whether gc was ever started without racing a concurrent first Subscribe.
+func (q *queue) ensureGC() {
+	q.gcOnce.Do(func() {
+		q.gc.low = atomic.LoadInt64(&q.reader.currentId)
+		q.gcInitLock.Lock()
+		q.gcTrigger = make(chan struct{}, 1)
+		q.gcStop = make(chan struct{})
+		q.gcDone = make(chan struct{})
+		q.gcInitLock.Unlock()
+		go q.runGC()
+	})
+}
+
+// triggerGC nudges the gc goroutine to run soon instead of waiting out the
+// rest of gcSweepInterval. A no-op before the first Subscribe.
+func (q *queue) triggerGC() {
+	q.gcInitLock.Lock()
+	trigger := q.gcTrigger
+	q.gcInitLock.Unlock()
+	if trigger == nil {
+		return
+	}
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+// gcHandles returns the stop/done channels of the background gc goroutine, if
+// one has been started, so Destroy can shut it down without racing a
+// concurrent first Subscribe/ensureGC.
+func (q *queue) gcHandles() (stop, done chan struct{}) {
+	q.gcInitLock.Lock()
+	defer q.gcInitLock.Unlock()
+	return q.gcStop, q.gcDone
+}
+
+func (q *queue) runGC() {
+	defer close(q.gcDone)
+	ticker := time.NewTicker(gcSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.gcStop:
+			return
+		case <-ticker.C:
+			q.collectGarbage()
+		case <-q.gcTrigger:
+			q.collectGarbage()
+		}
+	}
+}
+
+// collectGarbage removes every record behind the slowest subscriber's
+// cursor, advancing q.gc.low as it goes so a restart resumes exactly where
+// it left off (q.gc.low is re-seeded from the oldest file still on disk, via
+// synchronizeState, rather than persisted separately). With no subscribers
+// left (e.g. the last one just Unsubscribed), there is no cursor to wait on,
+// so it collects all the way up to the write cursor instead of leaving
+// records held forever.
+func (q *queue) collectGarbage() {
+	q.subs.lock.Lock()
+	var min int64
+	if len(q.subs.byName) == 0 {
+		min = atomic.LoadInt64(&q.writer.counter)
+	} else {
+		first := true
+		for _, c := range q.subs.byName {
+			c.lock.Lock()
+			id := c.currentId
+			c.lock.Unlock()
+			if first || id < min {
+				min, first = id, false
+			}
+		}
+	}
+	q.subs.lock.Unlock()
+
+	q.gc.lock.Lock()
+	defer q.gc.lock.Unlock()
+	for q.gc.low < min {
+		path := filepath.Join(q.directory, fmt.Sprint(q.gc.low, dataSuffix))
+		if size, err := recordPayloadSize(path); err == nil {
+			atomic.AddInt64(&q.totalBytes, -size)
+			atomic.AddInt64(&q.length, -1)
+		}
+		_ = os.Remove(path)
+		q.gc.low++
+	}
+}
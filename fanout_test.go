@@ -0,0 +1,239 @@
+package dfq
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueue_SubscribeIndependentCursors(t *testing.T) {
+	const dir = "./test/fanout"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	uploader, err := q.Subscribe("uploader")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	metrics, err := q.Subscribe("metrics")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := q.Put(bytes.NewBufferString("event1")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// uploader reads and commits...
+	f, err := uploader.Peek()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, _ := ioutil.ReadAll(f)
+	_ = f.Close()
+	if string(data) != "event1" {
+		t.Errorf("uploader got %q", data)
+	}
+	if err := uploader.Commit(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// give the background gc a moment to run; it should NOT have removed the
+	// record yet, since metrics has not committed past it.
+	time.Sleep(1200 * time.Millisecond)
+	if _, err := os.Stat(dir + "/0.data"); err != nil {
+		t.Errorf("record removed before every subscriber committed: %v", err)
+	}
+
+	// ...metrics reads and commits too, now the record can be collected.
+	f2, err := metrics.Peek()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data2, _ := ioutil.ReadAll(f2)
+	_ = f2.Close()
+	if string(data2) != "event1" {
+		t.Errorf("metrics got %q", data2)
+	}
+	if err := metrics.Commit(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := os.Stat(dir + "/0.data"); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Error("gc did not remove record once every subscriber committed past it")
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestQueue_SubscribeResumesCursorAcrossReopen(t *testing.T) {
+	const dir = "./test/fanout-resume"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("a")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("b")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	c, err := q.Subscribe("reader")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := c.Commit(); err != nil {
+		t.Error(err)
+		return
+	}
+	// Intentionally don't call q.Destroy(): it would delete dir, defeating
+	// the point of this test, which is that a fresh Open on the same
+	// directory picks the cursor back up from its persisted file.
+
+	q2, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q2.Destroy()
+	c2, err := q2.Subscribe("reader")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	v, err := GetString(c2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if v != "b" {
+		t.Errorf("expected cursor to resume past the committed record, got %q", v)
+	}
+}
+
+func TestQueue_Unsubscribe(t *testing.T) {
+	const dir = "./test/fanout-unsub"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	c, err := q.Subscribe("temp")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Unsubscribe("temp"); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := os.Stat(dir + "/cursors/temp.pos"); !os.IsNotExist(err) {
+		t.Error("cursor file should have been removed")
+	}
+	// The now-unsubscribed consumer still works standalone, it just no
+	// longer holds records open for gc purposes.
+	if _, err := c.Peek(); !errors.Is(err, ErrEmptyQueue) {
+		t.Errorf("expected ErrEmptyQueue, got %v", err)
+	}
+}
+
+// TestQueue_UnsubscribeLastReleasesRecords guards against the last
+// subscriber's Unsubscribe orphaning records on disk forever: with no
+// subscribers left to wait on, the gc must collect everything up to the
+// write cursor instead of leaving it pinned.
+func TestQueue_UnsubscribeLastReleasesRecords(t *testing.T) {
+	const dir = "./test/fanout-unsub-last"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if _, err := q.Subscribe("only"); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("event1")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Unsubscribe("only"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(1200 * time.Millisecond)
+	if _, err := os.Stat(dir + "/0.data"); !os.IsNotExist(err) {
+		t.Error("record should have been released once the last subscriber unsubscribed")
+	}
+}
+
+func BenchmarkQueue_SubscribePeekCommit(b *testing.B) {
+	q, err := Open("test/fanout-bench")
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	c, err := q.Subscribe("bench")
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	for i := 0; i < b.N; i++ {
+		if err := q.Put(bytes.NewBufferString("hello world")); err != nil {
+			b.Error(err)
+			return
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := c.Peek()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		_ = f.Close()
+		if err := c.Commit(); err != nil {
+			b.Error(err)
+			return
+		}
+	}
+	b.StopTimer()
+	_ = os.RemoveAll("test/fanout-bench")
+}
@@ -0,0 +1,189 @@
+package dfq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// inflightEntry is one outstanding reservation: how many times it has been
+// delivered, when the current delivery's visibility timeout expires (zero
+// means "not currently reserved, available for redelivery"), and whatever
+// backend-specific bookkeeping (e.g. segment file/position) is needed to
+// locate the record again.
+type inflightEntry struct {
+	Attempts int              `json:"attempts"`
+	Deadline time.Time        `json:"deadline,omitempty"`
+	Meta     map[string]int64 `json:"meta,omitempty"`
+}
+
+// inflightTracker persists outstanding Reserve() reservations to a sidecar
+// file, so they survive process restarts, and runs a background goroutine
+// that invokes onExpire for any reservation whose visibility timeout elapses
+// without an Ack/Nack. onExpire is also used to drive an explicit Nack: the
+// caller schedules a delayed expiry via requeue, or clears the deadline via
+// force and invokes onExpire itself for an immediate one.
+type inflightTracker struct {
+	path     string
+	onExpire func(id int64, attempts int, meta map[string]int64)
+
+	lock    sync.Mutex
+	entries map[int64]*inflightEntry
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newInflightTracker(path string, onExpire func(id int64, attempts int, meta map[string]int64)) (*inflightTracker, error) {
+	t := &inflightTracker{
+		path:     path,
+		onExpire: onExpire,
+		entries:  map[int64]*inflightEntry{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *inflightTracker) load() error {
+	raw, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(raw, &t.entries)
+}
+
+func (t *inflightTracker) save() error {
+	raw, err := json.Marshal(t.entries)
+	if err != nil {
+		return err
+	}
+	tmp := t.path + tempSuffix
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// begin records delivery attempt number Attempts+1 for id, due back
+// (expiring) after timeout, and returns the resulting attempt count.
+func (t *inflightTracker) begin(id int64, timeout time.Duration, meta map[string]int64) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	e, ok := t.entries[id]
+	if !ok {
+		e = &inflightEntry{}
+		t.entries[id] = e
+	}
+	e.Attempts++
+	e.Deadline = time.Now().Add(timeout)
+	e.Meta = meta
+	return e.Attempts, t.save()
+}
+
+// ack forgets id entirely: the message was committed and will never be redelivered.
+func (t *inflightTracker) ack(id int64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.entries, id)
+	return t.save()
+}
+
+// requeue schedules id to expire (and so be redelivered via onExpire) after
+// delay, without resetting its attempt count.
+func (t *inflightTracker) requeue(id int64, delay time.Duration) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	e, ok := t.entries[id]
+	if !ok {
+		return nil
+	}
+	e.Deadline = time.Now().Add(delay)
+	return t.save()
+}
+
+// force immediately clears id's deadline (as if its visibility timeout had
+// just elapsed) and returns its attempts/meta so the caller can redeliver it
+// synchronously, e.g. for a zero-delay Nack, instead of waiting on the
+// background sweep. found is false if id is not (or no longer) in flight.
+func (t *inflightTracker) force(id int64) (attempts int, meta map[string]int64, found bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	e, exists := t.entries[id]
+	if !exists {
+		return 0, nil, false
+	}
+	e.Deadline = time.Time{}
+	_ = t.save()
+	return e.Attempts, e.Meta, true
+}
+
+func (t *inflightTracker) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.sweep()
+		}
+	}
+}
+
+func (t *inflightTracker) sweep() {
+	type due struct {
+		id       int64
+		attempts int
+		meta     map[string]int64
+	}
+	now := time.Now()
+	var expired []due
+	t.lock.Lock()
+	for id, e := range t.entries {
+		if !e.Deadline.IsZero() && !e.Deadline.After(now) {
+			e.Deadline = time.Time{}
+			expired = append(expired, due{id, e.Attempts, e.Meta})
+		}
+	}
+	_ = t.save()
+	t.lock.Unlock()
+	for _, d := range expired {
+		t.onExpire(d.id, d.attempts, d.meta)
+	}
+}
+
+// minMeta returns the smallest Meta[key] across all outstanding entries that
+// carry it, used to find the oldest segment still referenced by an in-flight
+// reservation.
+func (t *inflightTracker) minMeta(key string) (int64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var min int64
+	found := false
+	for _, e := range t.entries {
+		v, ok := e.Meta[key]
+		if !ok {
+			continue
+		}
+		if !found || v < min {
+			min, found = v, true
+		}
+	}
+	return min, found
+}
+
+func (t *inflightTracker) close() {
+	close(t.stop)
+	<-t.done
+}
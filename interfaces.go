@@ -3,6 +3,7 @@ package dfq
 import (
 	"context"
 	"io"
+	"time"
 )
 
 // Queue designed for multiple writers and single consumer
@@ -21,12 +22,27 @@ type Queue interface {
 	Commit() error
 	// Peek oldest record or wait for new one
 	Wait(ctx context.Context) (io.ReadCloser, error)
+	// Reserve the oldest item like Peek, but do not commit it yet: the caller
+	// must Ack (commit) or Nack (requeue) the returned Message. A reservation
+	// that is neither Acked nor Nacked before timeout elapses is automatically
+	// redelivered, making this suitable as an at-least-once work queue rather
+	// than only a Peek/Commit buffer.
+	Reserve(ctx context.Context, timeout time.Duration) (Message, error)
 	// Remove allocated resources
 	Destroy() error
 	// Number of elements in queue
 	Len() int64
 }
 
+// Message is a reservation obtained from Queue.Reserve.
+type Message interface {
+	io.ReadCloser
+	// Ack commits the message, permanently removing it from the queue.
+	Ack() error
+	// Nack returns the message for redelivery after delay (0 means as soon as possible).
+	Nack(delay time.Duration) error
+}
+
 type emptyQueue int
 
 func (eq *emptyQueue) Error() string { return "Empty Queue" }
@@ -0,0 +1,104 @@
+package dfq
+
+import (
+	"fmt"
+	"time"
+)
+
+// Options configure a queue created with OpenWithOptions (segmented backend)
+// or passed to Open (classic backend). Zero value is valid and falls back to
+// sane defaults (see withDefaults).
+type Options struct {
+	// MaxBytesPerFile limits the size of a single segment file before rollover.
+	// Defaults to 100MB. Only used by the segmented backend.
+	MaxBytesPerFile int64
+	// SyncEvery batches fsync calls: the active segment is synced after this many
+	// writes. Defaults to 1 (fsync on every write). Only used by the segmented backend.
+	SyncEvery int64
+	// SyncTimeout forces a fsync if this much time passed since the last one, even
+	// if SyncEvery writes have not accumulated yet. It is checked on each write;
+	// there is no background timer, so writes after the last fsync stay unsynced
+	// until a later write triggers one. Zero disables the check.
+	// Only used by the segmented backend.
+	SyncTimeout time.Duration
+
+	// VerifyOnOpen validates every record's checksum while opening the queue,
+	// instead of only lazily when it is read. Corrupt records are handled
+	// according to RepairMode.
+	VerifyOnOpen bool
+	// RepairMode controls what happens to a corrupt record found during
+	// VerifyOnOpen. Defaults to RepairStrict. An online Verify scrub only
+	// reports corrupt records and does not use it.
+	RepairMode RepairMode
+
+	// MaxDepth caps the number of records the queue will hold. Zero (the
+	// default) means unlimited. Enforced on Put/PutContext/Stream according
+	// to OverflowPolicy. Only used by the classic backend (Open); the
+	// segmented backend does not enforce retention.
+	MaxDepth int64
+	// MaxBytes caps the total payload size the queue will hold. Zero (the
+	// default) means unlimited. Enforced the same way as MaxDepth. Only used
+	// by the classic backend.
+	MaxBytes int64
+	// MaxAge expires records older than this, checked by a background
+	// janitor that looks at each record file's mtime. Zero (the default)
+	// disables expiry. Only used by the classic backend. Not subscriber-
+	// aware: don't combine with Subscribe (see its doc comment).
+	MaxAge time.Duration
+	// OverflowPolicy controls what happens when MaxDepth or MaxBytes would be
+	// exceeded by an incoming record. Defaults to RejectNew. Only used by the
+	// classic backend. DropOldest is not subscriber-aware either; see MaxAge.
+	OverflowPolicy OverflowPolicy
+}
+
+// OverflowPolicy selects how a queue reacts to an incoming record that would
+// push it past MaxDepth or MaxBytes.
+type OverflowPolicy int
+
+const (
+	// RejectNew fails Put/PutContext/Stream with ErrQueueFull.
+	RejectNew OverflowPolicy = iota
+	// DropOldest evicts records from the read side (oldest first) to make
+	// room, same as calling Commit enough times.
+	DropOldest
+	// Block makes Put/PutContext/Stream wait until enough space is freed by
+	// the reader, or ctx is done. Put and Stream have no ctx of their own, so
+	// they block on context.Background() (i.e. forever, absent external
+	// cancellation); use PutContext for a bounded wait.
+	Block
+)
+
+// ErrQueueFull is returned by Put/PutContext/Stream under OverflowPolicy
+// RejectNew when MaxDepth or MaxBytes would be exceeded, and under DropOldest
+// when a record exceeds MaxBytes on its own even with the queue emptied.
+var ErrQueueFull = fmt.Errorf("dfq: queue full")
+
+// RepairMode selects how a corrupt record is handled once detected.
+type RepairMode int
+
+const (
+	// RepairStrict fails Open with an error: the classic backend lists the
+	// corrupt ids, the segmented backend names the first corrupt frame.
+	RepairStrict RepairMode = iota
+	// RepairSkipCorrupt moves the corrupt record out of the way (into a
+	// corrupt/ subdirectory of the queue) and continues. The segmented
+	// backend treats it the same as RepairTruncate.
+	RepairSkipCorrupt
+	// RepairTruncate discards everything from the first corrupt frame
+	// onward. Only meaningful for the segmented backend, where a corrupt
+	// frame usually means the rest of that segment is unrecoverable too; the
+	// classic (one-file-per-record) backend treats it the same as
+	// RepairSkipCorrupt, since there is nothing "after" a corrupt record
+	// within its own file.
+	RepairTruncate
+)
+
+func (o Options) withDefaults() Options {
+	if o.MaxBytesPerFile <= 0 {
+		o.MaxBytesPerFile = 100 * 1024 * 1024
+	}
+	if o.SyncEvery <= 0 {
+		o.SyncEvery = 1
+	}
+	return o
+}
@@ -1,8 +1,10 @@
 package dfq
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
@@ -11,33 +13,66 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
-	dataSuffix = ".data"
-	tempSuffix = ".temp"
+	dataSuffix   = ".data"
+	tempSuffix   = ".temp"
+	inflightFile = "inflight.json"
+
+	// janitorSweepInterval is how often the MaxAge janitor checks record
+	// mtimes. It is independent of MaxAge itself, so expiry is only ever late
+	// by up to this much, never early.
+	janitorSweepInterval = time.Second
 )
 
-// Open file-based queue
-func Open(directory string) (*queue, error) {
+// Open file-based queue, where one file is one record.
+//
+// For high-throughput queues with many small records, see OpenWithOptions,
+// which stores records in rolling segment files instead. An Options value
+// may be passed to enable VerifyOnOpen or retention (MaxDepth/MaxBytes/
+// MaxAge); it is otherwise unused by this backend.
+func Open(directory string, opts ...Options) (*queue, error) {
 	err := os.MkdirAll(directory, 0755)
 	if err != nil {
 		return nil, err
 	}
+	var o Options
+	if len(opts) > 0 {
+		o = opts[0]
+	}
 	q := &queue{
 		directory: directory,
-		notify:    make(chan struct{}, 1),
+		notify:    make(chan struct{}),
+		options:   o,
+	}
+	if err := q.synchronizeState(); err != nil {
+		return nil, err
 	}
-	return q, q.synchronizeState()
+	if o.VerifyOnOpen {
+		if err := q.verifyAndRepair(o.RepairMode); err != nil {
+			return nil, fmt.Errorf("dfq: open: %w", err)
+		}
+	}
+	if o.MaxAge > 0 {
+		q.janitorStop = make(chan struct{})
+		q.janitorDone = make(chan struct{})
+		go q.runJanitor(janitorSweepInterval)
+	}
+	return q, nil
 }
 
 // Single-process, file based queue, where one file is one record.
 //
-// It's designed to have multiple writers and one reader
+// It's designed to have multiple writers and one reader, unless Subscribe is
+// used to add independent named consumers (see fanout.go).
 type queue struct {
-	directory string
-	notify    chan struct{}
-	reader    struct {
+	directory  string
+	notifyLock sync.Mutex
+	notify     chan struct{}
+	options    Options
+	reader struct {
 		lock      sync.Mutex
 		currentId int64
 	}
@@ -45,12 +80,239 @@ type queue struct {
 		lock    sync.Mutex
 		counter int64
 	}
-	length int64
+	length     int64
+	totalBytes int64
+
+	// redeliver holds ids that expired (or were explicitly Nacked) while a
+	// later-numbered record was still validly reserved, so they must be
+	// handed out again without rewinding reader.currentId behind that later
+	// reservation (which would deliver it a second time). Reserve drains this
+	// before advancing the normal cursor.
+	redeliver struct {
+		lock sync.Mutex
+		ids  map[int64]struct{}
+	}
+
+	retry struct {
+		lock        sync.Mutex
+		maxAttempts int
+		deadLetter  Queue
+	}
+	inflightOnce sync.Once
+	inflight     *inflightTracker
+	inflightErr  error
+
+	janitorStop chan struct{}
+	janitorDone chan struct{}
+
+	subs struct {
+		lock   sync.Mutex
+		byName map[string]*consumer
+	}
+	gc struct {
+		lock sync.Mutex
+		low  int64
+	}
+	gcOnce     sync.Once
+	gcInitLock sync.Mutex
+	gcTrigger  chan struct{}
+	gcStop     chan struct{}
+	gcDone     chan struct{}
+}
+
+var _ Queue = (*queue)(nil)
+
+// SetRetryPolicy configures Reserve-based delivery: once a reservation has
+// been delivered maxAttempts times in all without an Ack, it is diverted to
+// deadLetter (if non-nil, otherwise just dropped) instead of being requeued
+// again. A maxAttempts of 0 (the default) means unlimited redelivery.
+func (q *queue) SetRetryPolicy(maxAttempts int, deadLetter Queue) {
+	q.retry.lock.Lock()
+	defer q.retry.lock.Unlock()
+	q.retry.maxAttempts = maxAttempts
+	q.retry.deadLetter = deadLetter
+}
+
+func (q *queue) ensureInflight() (*inflightTracker, error) {
+	q.inflightOnce.Do(func() {
+		q.inflight, q.inflightErr = newInflightTracker(filepath.Join(q.directory, inflightFile), q.onExpire)
+	})
+	return q.inflight, q.inflightErr
+}
+
+// popRedeliver removes and returns the lowest id queued for redelivery by
+// onExpire, if any. Lowest-first keeps redelivery order close to original
+// delivery order without needing a full priority queue for what is normally
+// a tiny, short-lived set.
+func (q *queue) popRedeliver() (int64, bool) {
+	q.redeliver.lock.Lock()
+	defer q.redeliver.lock.Unlock()
+	var id int64
+	found := false
+	for candidate := range q.redeliver.ids {
+		if !found || candidate < id {
+			id, found = candidate, true
+		}
+	}
+	if found {
+		delete(q.redeliver.ids, id)
+	}
+	return id, found
+}
+
+// Reserve peeks the oldest item without deleting it, and advances the read
+// cursor so the next Reserve/Peek sees the following item. The caller must
+// Ack or Nack the returned Message; an unresolved reservation is
+// automatically redelivered (at the same position) once timeout elapses.
+func (q *queue) Reserve(ctx context.Context, timeout time.Duration) (Message, error) {
+	tracker, err := q.ensureInflight()
+	if err != nil {
+		return nil, fmt.Errorf("dfq: reserve: %w", err)
+	}
+	for {
+		if id, ok := q.popRedeliver(); ok {
+			payload, readErr := readRecord(filepath.Join(q.directory, fmt.Sprint(id, dataSuffix)))
+			if readErr != nil {
+				if os.IsNotExist(readErr) {
+					// already acked/removed by the time it came back around; drop it.
+					continue
+				}
+				return nil, readErr
+			}
+			if _, err := tracker.begin(id, timeout, nil); err != nil {
+				return nil, fmt.Errorf("dfq: reserve: %w", err)
+			}
+			return &fileMessage{queue: q, id: id, payload: bytes.NewReader(payload)}, nil
+		}
+
+		q.reader.lock.Lock()
+		id := q.reader.currentId
+		payload, readErr := readRecord(filepath.Join(q.directory, fmt.Sprint(id, dataSuffix)))
+		if readErr == nil {
+			q.reader.currentId++
+		}
+		q.reader.lock.Unlock()
+
+		if readErr == nil {
+			if _, err := tracker.begin(id, timeout, nil); err != nil {
+				return nil, fmt.Errorf("dfq: reserve: %w", err)
+			}
+			return &fileMessage{queue: q, id: id, payload: bytes.NewReader(payload)}, nil
+		}
+		if os.IsNotExist(readErr) {
+			q.reader.lock.Lock()
+			gap := q.reader.currentId < atomic.LoadInt64(&q.writer.counter)
+			if gap {
+				// a gap left by a RepairSkipCorrupt/RepairTruncate repair: skip it.
+				q.reader.currentId++
+				atomic.AddInt64(&q.length, -1)
+			}
+			q.reader.lock.Unlock()
+			if gap {
+				continue
+			}
+			ch := q.waitChan()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-ch:
+			}
+			continue
+		}
+		return nil, readErr
+	}
+}
+
+// onExpire is invoked by the inflight tracker when a reservation's visibility
+// timeout elapses without an Ack/Nack. It either queues the item for
+// redelivery or, once the retry policy's MaxAttempts is exceeded, diverts it
+// to the dead letter queue. Redelivery never rewinds reader.currentId: doing
+// so would also re-hand-out any later, still validly reserved record that
+// the cursor had already moved past (see popRedeliver/Reserve).
+func (q *queue) onExpire(id int64, attempts int, _ map[string]int64) {
+	q.retry.lock.Lock()
+	maxAttempts, deadLetter := q.retry.maxAttempts, q.retry.deadLetter
+	q.retry.lock.Unlock()
+
+	path := filepath.Join(q.directory, fmt.Sprint(id, dataSuffix))
+	if maxAttempts > 0 && attempts >= maxAttempts {
+		if deadLetter != nil {
+			if payload, err := readRecord(path); err == nil {
+				_ = deadLetter.Put(bytes.NewReader(payload))
+			}
+		}
+		_ = q.inflight.ack(id)
+		atomic.AddInt64(&q.length, -1)
+		if size, err := recordPayloadSize(path); err == nil {
+			atomic.AddInt64(&q.totalBytes, -size)
+		}
+		_ = os.Remove(path)
+		return
+	}
+
+	q.redeliver.lock.Lock()
+	if q.redeliver.ids == nil {
+		q.redeliver.ids = map[int64]struct{}{}
+	}
+	q.redeliver.ids[id] = struct{}{}
+	q.redeliver.lock.Unlock()
+	q.notifyUpdate()
+}
+
+// fileMessage is the Message returned by queue.Reserve.
+type fileMessage struct {
+	queue   *queue
+	id      int64
+	payload *bytes.Reader
+}
+
+func (m *fileMessage) Read(p []byte) (int, error) { return m.payload.Read(p) }
+func (m *fileMessage) Close() error               { return nil }
+
+// Ack commits the message: the underlying file is removed and the reservation forgotten.
+func (m *fileMessage) Ack() error {
+	path := filepath.Join(m.queue.directory, fmt.Sprint(m.id, dataSuffix))
+	if err := m.queue.inflight.ack(m.id); err != nil {
+		return fmt.Errorf("dfq: ack: %w", err)
+	}
+	atomic.AddInt64(&m.queue.length, -1)
+	if size, err := recordPayloadSize(path); err == nil {
+		atomic.AddInt64(&m.queue.totalBytes, -size)
+	}
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Nack returns the message for redelivery after delay. A delay of 0 makes it
+// available again immediately instead of waiting for the background sweep.
+func (m *fileMessage) Nack(delay time.Duration) error {
+	if delay > 0 {
+		if err := m.queue.inflight.requeue(m.id, delay); err != nil {
+			return fmt.Errorf("dfq: nack: %w", err)
+		}
+		return nil
+	}
+	if attempts, meta, ok := m.queue.inflight.force(m.id); ok {
+		m.queue.onExpire(m.id, attempts, meta)
+	}
+	return nil
 }
 
-// Put data from stream to file. Could be run concurrently
+// Put data from stream to file. Could be run concurrently. Under
+// OverflowPolicy Block it waits on context.Background(), i.e. forever absent
+// external cancellation; use PutContext for a bounded wait.
 func (q *queue) Put(reader io.Reader) error {
-	return q.Stream(func(stream io.Writer) error {
+	return q.PutContext(context.Background(), reader)
+}
+
+// PutContext is like Put, but ctx bounds how long it waits for space to free
+// up under OverflowPolicy Block. It has no effect under RejectNew or
+// DropOldest, where admission is decided immediately.
+func (q *queue) PutContext(ctx context.Context, reader io.Reader) error {
+	return q.streamContext(ctx, func(stream io.Writer) error {
 		_, err := io.Copy(stream, reader)
 		if err != nil {
 			return fmt.Errorf("dfq: put: write temp file: %w", err)
@@ -60,18 +322,38 @@ func (q *queue) Put(reader io.Reader) error {
 }
 
 // Stream data to new queue entity. Entity will be automatically added to queue after finish without error.
+//
+// The record is written with a leading header (magic, version, CRC32 and
+// size) so that corruption can be detected on read; the header is written
+// here, before Attach, so that an already-framed file (as produced by Stream
+// itself, or moved between queues by Steal's fast path) can be attached with
+// a plain rename instead of being re-framed by Attach.
 func (q *queue) Stream(handler func(out io.Writer) error) error {
+	return q.streamContext(context.Background(), handler)
+}
+
+func (q *queue) streamContext(ctx context.Context, handler func(out io.Writer) error) error {
 	tmp, err := ioutil.TempFile(q.directory, "*.temp")
 	if err != nil {
 		return fmt.Errorf("dfq: put: create temp file: %w", err)
 	}
-	err = handler(tmp)
+	if _, err := tmp.Write(make([]byte, headerSize)); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("dfq: put: reserve header: %w", err)
+	}
+	hasher := crc32.NewIEEE()
+	counter := &byteCounter{}
+	err = handler(io.MultiWriter(tmp, hasher, counter))
+	if err == nil {
+		_, err = tmp.WriteAt(encodeHeader(hasher.Sum32(), counter.n), 0)
+	}
 	_ = tmp.Close()
 	if err != nil {
 		_ = os.Remove(tmp.Name())
 		return err
 	}
-	err = q.Attach(tmp.Name())
+	err = q.attachContext(ctx, tmp.Name())
 	if err != nil {
 		_ = os.Remove(tmp.Name())
 	}
@@ -83,9 +365,21 @@ func (q *queue) Steal(from Queue) error {
 		File() string
 	})
 	if ok {
-		err := q.Attach(fq.File())
-		if err == nil {
-			return from.Commit()
+		path := fq.File()
+		// Capture the record's size before Attach's rename moves the file out
+		// from under from: once moved, from.Commit() has nothing left on disk
+		// to read and so can't decrement from's own totalBytes for it.
+		size, sizeErr := recordPayloadSize(path)
+		if err := q.Attach(path); err == nil {
+			if err := from.Commit(); err != nil {
+				return err
+			}
+			if sizeErr == nil {
+				if fromQueue, ok := from.(*queue); ok {
+					atomic.AddInt64(&fromQueue.totalBytes, -size)
+				}
+			}
+			return nil
 		}
 	}
 	// fallback to full copy
@@ -102,19 +396,30 @@ func (q *queue) Steal(from Queue) error {
 	})
 }
 
-// Peek oldest file or return ErrNotExist. Can be called concurrently,
-// but reader should close stream manually and strictly before commit
+// Peek oldest file or return ErrEmptyQueue. Can be called concurrently, but
+// reader should close stream manually and strictly before commit. The
+// returned reader streams the payload directly from disk rather than
+// buffering it, checking its CRC32 as it is consumed: a corrupt payload
+// surfaces as ErrCorruptRecord from the final Read, not from Peek itself.
 func (q *queue) Peek() (io.ReadCloser, error) {
 	q.reader.lock.Lock()
 	defer q.reader.lock.Unlock()
-	f, err := os.Open(filepath.Join(q.directory, fmt.Sprint(q.reader.currentId, dataSuffix)))
-	if err == nil {
-		return f, nil
-	}
-	if os.IsNotExist(err) {
-		return nil, ErrEmptyQueue
+	for {
+		path := filepath.Join(q.directory, fmt.Sprint(q.reader.currentId, dataSuffix))
+		stream, err := openRecordStream(path)
+		if err == nil {
+			return stream, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if q.reader.currentId >= atomic.LoadInt64(&q.writer.counter) {
+			return nil, ErrEmptyQueue
+		}
+		// a gap left by a RepairSkipCorrupt/RepairTruncate repair: skip it.
+		q.reader.currentId++
+		atomic.AddInt64(&q.length, -1)
 	}
-	return nil, err
 }
 
 // Commit current file: remove it from FS and move reader sequence forward. It tolerates already removed item.
@@ -124,6 +429,9 @@ func (q *queue) Commit() error {
 	q.reader.currentId++
 	q.reader.lock.Unlock()
 	atomic.AddInt64(&q.length, -1)
+	if size, err := recordPayloadSize(path); err == nil {
+		atomic.AddInt64(&q.totalBytes, -size)
+	}
 	q.notifyUpdate()
 	err := os.Remove(path)
 	if os.IsNotExist(err) {
@@ -142,34 +450,159 @@ func (q *queue) Wait(ctx context.Context) (io.ReadCloser, error) {
 		if err != ErrEmptyQueue {
 			return nil, err
 		}
+		ch := q.waitChan()
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
-		case <-q.notify:
+		case <-ch:
 		}
 	}
 }
 
 func (q *queue) Len() int64 {
-	return q.length
+	return atomic.LoadInt64(&q.length)
 }
 
 // Remove everything in a queue directory (and directory itself)
 func (q *queue) Destroy() error {
+	if q.inflight != nil {
+		q.inflight.close()
+	}
+	if q.janitorStop != nil {
+		close(q.janitorStop)
+		<-q.janitorDone
+	}
+	if stop, done := q.gcHandles(); stop != nil {
+		close(stop)
+		<-done
+	}
 	return os.RemoveAll(q.directory)
 }
 
-// Attach external file to the queue (and removing/moving original).
+// runJanitor periodically expires records older than MaxAge until Destroy
+// stops it.
+func (q *queue) runJanitor(interval time.Duration) {
+	defer close(q.janitorDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.janitorStop:
+			return
+		case <-ticker.C:
+			q.expireOld()
+		}
+	}
+}
+
+// expireOld commits every record at the head of the queue whose file mtime is
+// older than MaxAge, oldest first, stopping at the first record that is
+// still within MaxAge (records are read in creation order, so nothing behind
+// it can be older).
+func (q *queue) expireOld() {
+	for {
+		q.reader.lock.Lock()
+		path := filepath.Join(q.directory, fmt.Sprint(q.reader.currentId, dataSuffix))
+		q.reader.lock.Unlock()
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if time.Since(info.ModTime()) < q.options.MaxAge {
+			return
+		}
+		if err := q.Commit(); err != nil {
+			return
+		}
+	}
+}
+
+// Attach external file to the queue (and removing/moving original). Subject
+// to the same MaxDepth/MaxBytes/OverflowPolicy admission as Put; it waits on
+// context.Background() under OverflowPolicy Block. file does not need to be
+// pre-framed with a dfq record header: Attach adds one (the same
+// [magic][version][crc32][size] header Put/Stream write) if file doesn't
+// already have a valid one, same as any other externally-sourced record.
 func (q *queue) Attach(file string) error {
-	err := q.attachToQueue(file)
+	return q.attachContext(context.Background(), file)
+}
+
+func (q *queue) attachContext(ctx context.Context, file string) error {
+	size, err := recordPayloadSize(file)
 	if err != nil {
+		return q.attachUnframed(ctx, file)
+	}
+	if err := q.admit(ctx, size); err != nil {
+		return err
+	}
+	if err := q.attachToQueue(file); err != nil {
 		return fmt.Errorf("dfq: attach to queue: %w", err)
 	}
 	atomic.AddInt64(&q.length, 1)
+	atomic.AddInt64(&q.totalBytes, size)
 	q.notifyUpdate()
 	return nil
 }
 
+// attachUnframed adds a dfq record header to file via the same streamContext
+// path Put/Stream use, then attaches the framed copy and removes the
+// original, so Attach works on arbitrary external files and not just the
+// already-framed ones Steal's fast path and Stream hand it.
+func (q *queue) attachUnframed(ctx context.Context, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("dfq: attach to queue: %w", err)
+	}
+	defer in.Close()
+	if err := q.streamContext(ctx, func(out io.Writer) error {
+		_, err := io.Copy(out, in)
+		return err
+	}); err != nil {
+		return fmt.Errorf("dfq: attach to queue: %w", err)
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("dfq: attach to queue: %w", err)
+	}
+	return nil
+}
+
+// admit blocks (per ctx and OverflowPolicy) until adding a record of size
+// bytes would not push the queue past MaxDepth or MaxBytes, or reports why it
+// can't: ErrQueueFull under RejectNew, or ctx.Err() if ctx ends first under
+// Block.
+func (q *queue) admit(ctx context.Context, size int64) error {
+	for {
+		depth := atomic.LoadInt64(&q.length)
+		total := atomic.LoadInt64(&q.totalBytes)
+		overDepth := q.options.MaxDepth > 0 && depth >= q.options.MaxDepth
+		overBytes := q.options.MaxBytes > 0 && total+size > q.options.MaxBytes
+		if !overDepth && !overBytes {
+			return nil
+		}
+		switch q.options.OverflowPolicy {
+		case DropOldest:
+			if depth == 0 {
+				// Nothing left to evict and the record still doesn't fit on
+				// its own (it exceeds MaxBytes by itself): committing an
+				// already-empty queue would just spin forever.
+				return ErrQueueFull
+			}
+			if err := q.Commit(); err != nil {
+				return err
+			}
+		case Block:
+			ch := q.waitChan()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ch:
+			}
+		default:
+			return ErrQueueFull
+		}
+	}
+}
+
 // Current peek file path. File may not exists if queue is altered or empty.
 func (q *queue) File() string {
 	return filepath.Join(q.directory, fmt.Sprint(q.reader.currentId, dataSuffix))
@@ -183,16 +616,25 @@ func (q *queue) attachToQueue(oldName string) error {
 	if err != nil {
 		return fmt.Errorf("rename temp file to queue element: %w", err)
 	}
-	q.writer.counter = id + 1
+	atomic.StoreInt64(&q.writer.counter, id+1)
 	return nil
 }
 
-func (q *queue) notifyUpdate() {
-	select {
-	case q.notify <- struct{}{}:
-	default:
+// waitChan returns the channel that will be closed the next time
+// notifyUpdate runs. Closing (rather than sending on) it broadcasts the
+// wakeup to every blocked Peek/Reserve/Wait caller, including every
+// Consumer's Wait, instead of handing it to only one of them.
+func (q *queue) waitChan() chan struct{} {
+	q.notifyLock.Lock()
+	defer q.notifyLock.Unlock()
+	return q.notify
+}
 
-	}
+func (q *queue) notifyUpdate() {
+	q.notifyLock.Lock()
+	close(q.notify)
+	q.notify = make(chan struct{})
+	q.notifyLock.Unlock()
 }
 
 func (q *queue) synchronizeState() error {
@@ -202,20 +644,26 @@ func (q *queue) synchronizeState() error {
 	}
 	var min int64
 	var max int64
-	for i, file := range list {
+	var count int64
+	var totalBytes int64
+	for _, file := range list {
 		name := file.Name()
 		if strings.HasSuffix(name, dataSuffix) {
 			id, err := strconv.ParseInt(name[:len(name)-len(dataSuffix)], 10, 64)
 			if err != nil {
 				return err
 			}
-			if i == 0 {
+			if count == 0 {
 				min, max = id, id
 			} else if id > max {
 				max = id
 			} else if id < min {
 				min = id
 			}
+			count++
+			if size, err := recordPayloadSize(filepath.Join(q.directory, name)); err == nil {
+				totalBytes += size
+			}
 		} else if strings.HasSuffix(name, tempSuffix) {
 			err = os.Remove(filepath.Join(q.directory, name))
 			if err != nil {
@@ -225,7 +673,11 @@ func (q *queue) synchronizeState() error {
 	}
 	q.reader.currentId = min
 	q.writer.counter = max
-	q.length = max - min
+	if count > 0 {
+		q.writer.counter++
+	}
+	q.length = count
+	q.totalBytes = totalBytes
 	return nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -186,6 +187,375 @@ func TestQueue_Steal(t *testing.T) {
 	}
 }
 
+// TestQueue_AttachUnframedFile guards against Attach rejecting an ordinary
+// external file with "bad magic: corrupt record": file is not expected to
+// already carry a dfq record header, Attach must frame it itself.
+func TestQueue_AttachUnframedFile(t *testing.T) {
+	const dir = "./test/attach-unframed"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	external := filepath.Join(dir, "external.txt")
+	if err := ioutil.WriteFile(external, []byte("plain data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Attach(external); err != nil {
+		t.Errorf("Attach should frame an unheadered file, got %v", err)
+		return
+	}
+	if _, err := os.Stat(external); !os.IsNotExist(err) {
+		t.Errorf("Attach should remove the original file, got %v", err)
+	}
+
+	v, err := GetString(q)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if v != "plain data" {
+		t.Errorf("unexpected attached payload: %q", v)
+	}
+}
+
+// TestQueue_StealDecrementsSourceTotalBytes guards against Steal's fast path
+// leaking totalBytes on the source queue: fq.File() is renamed away by
+// Attach before from.Commit() runs, so Commit can no longer read the file to
+// account for it, and totalBytes must be decremented by Steal itself instead.
+func TestQueue_StealDecrementsSourceTotalBytes(t *testing.T) {
+	q, err := Open("./test/steal-totalbytes-src", Options{MaxBytes: 5})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	q2, err := Open("./test/steal-totalbytes-dst")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q2.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("hello")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := q2.Steal(q); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if q.Len() != 0 {
+		t.Errorf("source queue should be empty after steal")
+	}
+	if q.totalBytes != 0 {
+		t.Errorf("source queue totalBytes should be 0 after steal, got %d", q.totalBytes)
+	}
+
+	// if totalBytes had leaked, MaxBytes:5 would now permanently reject any
+	// new record the same size as the one that was stolen away.
+	if err := q.Put(bytes.NewBufferString("again")); err != nil {
+		t.Errorf("source queue should accept a new record after steal, got %v", err)
+	}
+}
+
+func TestQueue_ReserveAckNack(t *testing.T) {
+	q, err := Open("./test/reserve")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("hello")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	msg, err := q.Reserve(ctx, 200*time.Millisecond)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := ioutil.ReadAll(msg)
+	_ = msg.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "hello" {
+		t.Error("corrupted")
+		return
+	}
+	if q.Len() != 1 {
+		t.Error("reserved item should still count towards queue length until Ack")
+		return
+	}
+
+	// neither Ack nor Nack: the visibility timeout should redeliver it
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel2()
+	msg2, err := q.Reserve(ctx2, 1*time.Second)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data2, err := ioutil.ReadAll(msg2)
+	_ = msg2.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data2) != "hello" {
+		t.Error("expected redelivery of unacknowledged message")
+		return
+	}
+
+	if err := msg2.Nack(0); err != nil {
+		t.Error(err)
+		return
+	}
+	msg3, err := q.Reserve(ctx2, 1*time.Second)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := msg3.Ack(); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 0 {
+		t.Error("queue should be empty after Ack")
+	}
+}
+
+// TestQueue_ReserveExpiryDoesNotDuplicateLaterReservation guards against
+// redelivery rewinding the shared read cursor behind a still validly
+// reserved later record, which would hand that record out a second time.
+func TestQueue_ReserveExpiryDoesNotDuplicateLaterReservation(t *testing.T) {
+	q, err := Open("./test/reserve-expiry-order")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("a")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("b")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if _, err := q.Reserve(ctx, 200*time.Millisecond); err != nil { // a, short timeout
+		t.Error(err)
+		return
+	}
+	msgB, err := q.Reserve(ctx, 2*time.Second) // b, long timeout
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(500 * time.Millisecond) // past a's timeout, well within b's
+
+	redelivered, err := q.Reserve(ctx, time.Second)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := ioutil.ReadAll(redelivered)
+	_ = redelivered.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "a" {
+		t.Errorf("expected redelivery of expired item 'a', got %q", data)
+	}
+	if err := redelivered.Ack(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// b is still validly reserved: there is nothing else to deliver, so
+	// Reserve must block instead of handing b out a second time.
+	ctxShort, cancelShort := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelShort()
+	if _, err := q.Reserve(ctxShort, time.Second); err != context.DeadlineExceeded {
+		t.Errorf("expected Reserve to block while b is still reserved, got %v", err)
+	}
+
+	if err := msgB.Ack(); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 0 {
+		t.Error("queue should be empty after both Acks")
+	}
+}
+
+func TestQueue_MaxDepthRejectNew(t *testing.T) {
+	q, err := Open("./test/maxdepth-reject", Options{MaxDepth: 1})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("first")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("second")); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if q.Len() != 1 {
+		t.Error("rejected put should not have been added")
+	}
+}
+
+func TestQueue_MaxDepthDropOldest(t *testing.T) {
+	q, err := Open("./test/maxdepth-drop", Options{MaxDepth: 1, OverflowPolicy: DropOldest})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("first")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("second")); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 1 {
+		t.Error("depth should stay at MaxDepth after eviction")
+	}
+	s, err := GetString(q)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s != "second" {
+		t.Error("oldest record should have been evicted")
+	}
+}
+
+// TestQueue_MaxBytesDropOldestOversizedRecord guards against admit looping
+// forever committing an already-empty queue when a single record exceeds
+// MaxBytes on its own, so no amount of eviction can make it fit.
+func TestQueue_MaxBytesDropOldestOversizedRecord(t *testing.T) {
+	q, err := Open("./test/maxbytes-drop-oversized", Options{MaxBytes: 4, OverflowPolicy: DropOldest})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("12")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Put(bytes.NewBufferString("toolong"))
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrQueueFull) {
+			t.Errorf("expected ErrQueueFull, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Put spun forever instead of rejecting an oversized record")
+		return
+	}
+	if q.Len() != 0 {
+		t.Error("the oldest (and only) record should have been evicted while making room")
+	}
+}
+
+func TestQueue_MaxBytesBlock(t *testing.T) {
+	q, err := Open("./test/maxbytes-block", Options{MaxBytes: 4, OverflowPolicy: Block})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("1234")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- q.PutContext(ctx, bytes.NewBufferString("5"))
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("PutContext should have blocked until space was freed, returned: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := q.Commit(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueue_MaxAgeJanitor(t *testing.T) {
+	q, err := Open("./test/maxage", Options{MaxAge: 300 * time.Millisecond})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("stale")); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 1 {
+		t.Error("queue size should be 1")
+		return
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for q.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Error("janitor should have expired the stale record")
+	}
+}
+
 func BenchmarkQueue_Put(b *testing.B) {
 	q, err := Open("test/queue")
 	if err != nil {
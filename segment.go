@@ -0,0 +1,941 @@
+package dfq
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix  = ".dat"
+	segmentNameFmt = "%016d" + segmentSuffix
+	segmentMeta    = "state.json"
+	segmentMetaTmp = "state.json.temp"
+
+	frameLengthSize = 4
+	frameCrcSize    = 4
+	frameOverhead   = frameLengthSize + frameCrcSize
+)
+
+// ErrCorruptRecord is returned by Peek when the next frame fails its CRC check
+// or is otherwise short/unreadable. The reader does not advance past it, so
+// callers can decide whether to Commit (skip) or abort.
+var ErrCorruptRecord = fmt.Errorf("dfq: corrupt record")
+
+// segmentState is the on-disk, periodically fsynced bookkeeping for a
+// segmentedQueue: read/write cursors plus the number of records still pending.
+type segmentState struct {
+	ReadFileNum  int64 `json:"read_file_num"`
+	ReadPos      int64 `json:"read_pos"`
+	WriteFileNum int64 `json:"write_file_num"`
+	WritePos     int64 `json:"write_pos"`
+	Depth        int64 `json:"depth"`
+	// LowestFileNum is the oldest segment file number not yet deleted. It only
+	// moves independently from ReadFileNum when Reserve/Ack is used, since a
+	// segment consumed by Reserve can't be deleted until nothing is still
+	// in-flight against it (see tryCompact).
+	LowestFileNum int64 `json:"lowest_file_num"`
+}
+
+// encodeID packs a segment file number and in-file offset into the int64 id
+// Reserve hands out, so redelivery can rewind straight back to that frame
+// without any extra bookkeeping beyond the inflight tracker itself.
+func encodeID(fileNum, pos int64) int64 {
+	return (fileNum << 48) | (pos & 0xFFFFFFFFFFFF)
+}
+
+func decodeID(id int64) (fileNum, pos int64) {
+	return id >> 48, id & 0xFFFFFFFFFFFF
+}
+
+// segmentedQueue is a log-structured, file-based Queue backend: records are
+// appended into rolling segment files instead of one file per record, which
+// avoids the per-message inode/dirent overhead of queue.
+type segmentedQueue struct {
+	directory string
+	options   Options
+	notify    chan struct{}
+
+	stateLock sync.Mutex
+	state     segmentState
+
+	writeLock    sync.Mutex
+	writeFile    *os.File
+	writesSince  int64
+	lastSyncTime time.Time
+
+	readLock sync.Mutex
+	readFile *os.File
+
+	retry struct {
+		lock        sync.Mutex
+		maxAttempts int
+		deadLetter  Queue
+	}
+	inflightOnce sync.Once
+	inflight     *inflightTracker
+	inflightErr  error
+
+	// redeliver holds ids that expired (or were explicitly Nacked) while a
+	// later frame was still validly reserved, so they must be handed out
+	// again without rewinding the read cursor behind that later reservation
+	// (which would deliver it a second time). tryReserve drains this before
+	// advancing the normal cursor.
+	redeliver struct {
+		lock sync.Mutex
+		ids  map[int64]struct{}
+	}
+}
+
+var _ Queue = (*segmentedQueue)(nil)
+
+// SetRetryPolicy configures Reserve-based delivery: once a reservation has
+// been delivered maxAttempts times in all without an Ack, it is diverted to
+// deadLetter (if non-nil, otherwise just dropped) instead of being requeued
+// again. A maxAttempts of 0 (the default) means unlimited redelivery.
+func (q *segmentedQueue) SetRetryPolicy(maxAttempts int, deadLetter Queue) {
+	q.retry.lock.Lock()
+	defer q.retry.lock.Unlock()
+	q.retry.maxAttempts = maxAttempts
+	q.retry.deadLetter = deadLetter
+}
+
+// OpenWithOptions opens (creating if needed) a segmented, log-structured queue
+// in directory. Unlike Open, it amortizes filesystem overhead across many
+// records per segment file, which makes it better suited for high-throughput
+// queues.
+func OpenWithOptions(directory string, opts Options) (*segmentedQueue, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	sq := &segmentedQueue{
+		directory: directory,
+		options:   opts.withDefaults(),
+		notify:    make(chan struct{}, 1),
+	}
+	if err := sq.loadState(); err != nil {
+		return nil, fmt.Errorf("dfq: open segmented queue: %w", err)
+	}
+	if err := sq.recoverTail(); err != nil {
+		return nil, fmt.Errorf("dfq: open segmented queue: recover tail: %w", err)
+	}
+	if sq.options.VerifyOnOpen {
+		if err := sq.verifyAndRepair(sq.options.RepairMode); err != nil {
+			return nil, fmt.Errorf("dfq: open segmented queue: %w", err)
+		}
+	}
+	return sq, nil
+}
+
+func (q *segmentedQueue) segmentPath(num int64) string {
+	return filepath.Join(q.directory, fmt.Sprintf(segmentNameFmt, num))
+}
+
+func (q *segmentedQueue) loadState() error {
+	raw, err := ioutil.ReadFile(filepath.Join(q.directory, segmentMeta))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(raw, &q.state)
+}
+
+// saveState persists the cursors atomically: write to a temp file, fsync,
+// rename, then fsync the directory so the rename itself is crash-durable too.
+func (q *segmentedQueue) saveState() error {
+	raw, err := json.Marshal(&q.state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(q.directory, segmentMetaTmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(raw); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.directory, segmentMeta)); err != nil {
+		return err
+	}
+	dir, err := os.Open(q.directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// recoverTail truncates a partially written record at the end of the write
+// segment left behind by a crash, detected via a short read or CRC mismatch.
+func (q *segmentedQueue) recoverTail() error {
+	path := q.segmentPath(q.state.WriteFileNum)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pos := int64(0)
+	for {
+		n, ferr := readFrame(f)
+		if ferr == io.EOF {
+			break
+		}
+		if ferr != nil {
+			// Partial/corrupt tail frame: truncate to the last known-good position.
+			break
+		}
+		pos += n
+	}
+	if err := f.Truncate(pos); err != nil {
+		return err
+	}
+	q.state.WritePos = pos
+	return q.saveState()
+}
+
+// readFrame reads one [length][payload][crc32] frame from f (positioned right
+// after the previous frame) and returns its total on-disk size, discarding the
+// payload. Used only for scanning/validation.
+func readFrame(f *os.File) (int64, error) {
+	var lengthBuf [frameLengthSize]byte
+	if _, err := io.ReadFull(f, lengthBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(f, payload); err != nil {
+		return 0, io.EOF
+	}
+	var crcBuf [frameCrcSize]byte
+	if _, err := io.ReadFull(f, crcBuf[:]); err != nil {
+		return 0, io.EOF
+	}
+	if binary.BigEndian.Uint32(crcBuf[:]) != crc32.ChecksumIEEE(payload) {
+		return 0, ErrCorruptRecord
+	}
+	return int64(frameOverhead) + int64(length), nil
+}
+
+// verifyAndRepair scans every not-yet-consumed frame, from the current read
+// cursor up to the write cursor, and stops at the first corrupt one it finds.
+// Frames already behind the read cursor are ignored: they are either already
+// committed or already deleted, so there is nothing left to repair there.
+func (q *segmentedQueue) verifyAndRepair(mode RepairMode) error {
+	fileNum, pos := q.state.ReadFileNum, q.state.ReadPos
+	var f *os.File
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+	}()
+	for {
+		if fileNum == q.state.WriteFileNum && pos >= q.state.WritePos {
+			return nil
+		}
+		if f == nil {
+			var err error
+			f, err = os.Open(q.segmentPath(fileNum))
+			if err != nil {
+				return fmt.Errorf("open segment %d: %w", fileNum, err)
+			}
+		}
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return fmt.Errorf("seek segment %d: %w", fileNum, err)
+		}
+		size, err := readFrame(f)
+		if err == io.EOF {
+			_ = f.Close()
+			f = nil
+			fileNum++
+			pos = 0
+			continue
+		}
+		if err != nil {
+			if mode == RepairStrict {
+				return fmt.Errorf("corrupt record at segment %d offset %d: %w", fileNum, pos, ErrCorruptRecord)
+			}
+			// RepairSkipCorrupt and RepairTruncate are equivalent here: once a
+			// frame is corrupt there is no reliable way to find where the next
+			// one begins, so everything from this point on is discarded.
+			_ = f.Close()
+			f = nil
+			return q.truncateAt(fileNum, pos)
+		}
+		pos += size
+	}
+}
+
+// truncateAt discards every frame from (fileNum, pos) onward: later segment
+// files are removed outright and the write cursor is rewound to the
+// corruption point, with depth recounted so Len stays accurate.
+func (q *segmentedQueue) truncateAt(fileNum, pos int64) error {
+	for n := q.state.WriteFileNum; n > fileNum; n-- {
+		_ = os.Remove(q.segmentPath(n))
+	}
+	if err := os.Truncate(q.segmentPath(fileNum), pos); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("truncate segment %d: %w", fileNum, err)
+	}
+	depth, err := q.countFrames(q.state.ReadFileNum, q.state.ReadPos, fileNum, pos)
+	if err != nil {
+		return fmt.Errorf("recount depth: %w", err)
+	}
+	q.state.WriteFileNum = fileNum
+	q.state.WritePos = pos
+	q.state.Depth = depth
+	return q.saveState()
+}
+
+// countFrames counts the whole frames between [fromFileNum, fromPos) and
+// [toFileNum, toPos), used to recompute Depth after a repair truncates the
+// write cursor.
+func (q *segmentedQueue) countFrames(fromFileNum, fromPos, toFileNum, toPos int64) (int64, error) {
+	var count int64
+	fileNum, pos := fromFileNum, fromPos
+	for fileNum < toFileNum || (fileNum == toFileNum && pos < toPos) {
+		f, err := os.Open(q.segmentPath(fileNum))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			_ = f.Close()
+			return 0, err
+		}
+		size, err := readFrame(f)
+		_ = f.Close()
+		if err == io.EOF {
+			fileNum++
+			pos = 0
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		pos += size
+		count++
+	}
+	return count, nil
+}
+
+// Verify scans every not-yet-consumed record and reports its status on the
+// returned channel, which is closed once the scan finishes, ctx is done, or a
+// corrupt frame is hit (since there is then no reliable way to find where the
+// next one begins). Unlike VerifyOnOpen, it does not repair anything.
+func (q *segmentedQueue) Verify(ctx context.Context) (<-chan VerifyEvent, error) {
+	q.stateLock.Lock()
+	fileNum, pos := q.state.ReadFileNum, q.state.ReadPos
+	endFileNum, endPos := q.state.WriteFileNum, q.state.WritePos
+	q.stateLock.Unlock()
+
+	events := make(chan VerifyEvent)
+	go func() {
+		defer close(events)
+		var f *os.File
+		defer func() {
+			if f != nil {
+				_ = f.Close()
+			}
+		}()
+		for {
+			if fileNum == endFileNum && pos >= endPos {
+				return
+			}
+			if f == nil {
+				var err error
+				f, err = os.Open(q.segmentPath(fileNum))
+				if err != nil {
+					select {
+					case events <- VerifyEvent{ID: encodeID(fileNum, pos), Err: err}:
+					case <-ctx.Done():
+					}
+					return
+				}
+			}
+			if _, err := f.Seek(pos, io.SeekStart); err != nil {
+				return
+			}
+			size, err := readFrame(f)
+			if err == io.EOF {
+				_ = f.Close()
+				f = nil
+				fileNum++
+				pos = 0
+				continue
+			}
+			select {
+			case events <- VerifyEvent{ID: encodeID(fileNum, pos), Err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+			pos += size
+		}
+	}()
+	return events, nil
+}
+
+// Put data from stream to the queue. Could be run concurrently.
+func (q *segmentedQueue) Put(reader io.Reader) error {
+	payload, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("dfq: put: read payload: %w", err)
+	}
+	return q.append(payload)
+}
+
+// Stream data to new queue entity. The handler's output is buffered in memory
+// and then appended as a single record.
+func (q *segmentedQueue) Stream(handler func(out io.Writer) error) error {
+	var buf writerBuffer
+	if err := handler(&buf); err != nil {
+		return err
+	}
+	return q.append(buf.data)
+}
+
+type writerBuffer struct {
+	data []byte
+}
+
+func (b *writerBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+func (q *segmentedQueue) append(payload []byte) error {
+	q.writeLock.Lock()
+	defer q.writeLock.Unlock()
+
+	if q.writeFile == nil {
+		f, err := os.OpenFile(q.segmentPath(q.state.WriteFileNum), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("dfq: append: open write segment: %w", err)
+		}
+		q.writeFile = f
+	}
+
+	if q.state.WritePos > 0 && q.state.WritePos+int64(frameOverhead+len(payload)) > q.options.MaxBytesPerFile {
+		if err := q.rollSegment(); err != nil {
+			return fmt.Errorf("dfq: append: roll segment: %w", err)
+		}
+	}
+
+	var header [frameLengthSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	var footer [frameCrcSize]byte
+	binary.BigEndian.PutUint32(footer[:], crc32.ChecksumIEEE(payload))
+
+	if _, err := q.writeFile.Write(header[:]); err != nil {
+		return fmt.Errorf("dfq: append: write length: %w", err)
+	}
+	if _, err := q.writeFile.Write(payload); err != nil {
+		return fmt.Errorf("dfq: append: write payload: %w", err)
+	}
+	if _, err := q.writeFile.Write(footer[:]); err != nil {
+		return fmt.Errorf("dfq: append: write crc: %w", err)
+	}
+
+	q.state.WritePos += int64(frameOverhead + len(payload))
+	q.writesSince++
+	if q.writesSince >= q.options.SyncEvery ||
+		(q.options.SyncTimeout > 0 && time.Since(q.lastSyncTime) >= q.options.SyncTimeout) {
+		if err := q.writeFile.Sync(); err != nil {
+			return fmt.Errorf("dfq: append: fsync: %w", err)
+		}
+		q.writesSince = 0
+		q.lastSyncTime = time.Now()
+	}
+
+	q.stateLock.Lock()
+	q.state.Depth++
+	err := q.saveState()
+	q.stateLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("dfq: append: save state: %w", err)
+	}
+	q.notifyUpdate()
+	return nil
+}
+
+// rollSegment closes out the current write segment and opens the next one.
+// The new segment number is only persisted to the state file once it has been
+// created, so a crash mid-rollover simply resumes writing the old segment.
+func (q *segmentedQueue) rollSegment() error {
+	next := q.state.WriteFileNum + 1
+	f, err := os.OpenFile(q.segmentPath(next), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := q.writeFile.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	_ = q.writeFile.Close()
+	q.writeFile = f
+	q.state.WriteFileNum = next
+	q.state.WritePos = 0
+	q.writesSince = 0
+	return nil
+}
+
+// Steal copies the oldest item from another queue into this one and commits
+// it in the original. segmentedQueue has no single-file-per-record shortcut,
+// so it always falls back to a full copy.
+func (q *segmentedQueue) Steal(from Queue) error {
+	return q.Stream(func(out io.Writer) error {
+		in, err := from.Peek()
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+		return from.Commit()
+	})
+}
+
+// Peek the oldest record, or ErrEmptyQueue if the queue is exhausted. Returns
+// ErrCorruptRecord (wrapped) if the next frame fails its CRC check; the reader
+// does not advance in that case.
+func (q *segmentedQueue) Peek() (io.ReadCloser, error) {
+	q.readLock.Lock()
+	defer q.readLock.Unlock()
+
+	q.stateLock.Lock()
+	readFileNum, readPos, writeFileNum, writePos := q.state.ReadFileNum, q.state.ReadPos, q.state.WriteFileNum, q.state.WritePos
+	q.stateLock.Unlock()
+
+	if readFileNum == writeFileNum && readPos >= writePos {
+		return nil, ErrEmptyQueue
+	}
+
+	if q.readFile == nil {
+		f, err := os.Open(q.segmentPath(readFileNum))
+		if err != nil {
+			return nil, fmt.Errorf("dfq: peek: open segment: %w", err)
+		}
+		q.readFile = f
+	}
+	if _, err := q.readFile.Seek(readPos, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("dfq: peek: seek: %w", err)
+	}
+
+	var lengthBuf [frameLengthSize]byte
+	if _, err := io.ReadFull(q.readFile, lengthBuf[:]); err != nil {
+		return nil, fmt.Errorf("dfq: peek: read length: %w", ErrCorruptRecord)
+	}
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(q.readFile, payload); err != nil {
+		return nil, fmt.Errorf("dfq: peek: read payload: %w", ErrCorruptRecord)
+	}
+	var crcBuf [frameCrcSize]byte
+	if _, err := io.ReadFull(q.readFile, crcBuf[:]); err != nil {
+		return nil, fmt.Errorf("dfq: peek: read crc: %w", ErrCorruptRecord)
+	}
+	if binary.BigEndian.Uint32(crcBuf[:]) != crc32.ChecksumIEEE(payload) {
+		return nil, fmt.Errorf("dfq: peek: frame %d@%d: %w", readFileNum, readPos, ErrCorruptRecord)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(payload)), nil
+}
+
+// Commit advances the read cursor past the current record, deleting the
+// segment file once it has been fully consumed.
+func (q *segmentedQueue) Commit() error {
+	q.readLock.Lock()
+	defer q.readLock.Unlock()
+
+	q.stateLock.Lock()
+	if q.state.ReadFileNum == q.state.WriteFileNum && q.state.ReadPos >= q.state.WritePos {
+		q.stateLock.Unlock()
+		return nil
+	}
+
+	f := q.readFile
+	if f == nil {
+		var err error
+		f, err = os.Open(q.segmentPath(q.state.ReadFileNum))
+		if err != nil {
+			q.stateLock.Unlock()
+			return fmt.Errorf("dfq: commit: open segment: %w", err)
+		}
+		q.readFile = f
+	}
+	if _, err := f.Seek(q.state.ReadPos, io.SeekStart); err != nil {
+		q.stateLock.Unlock()
+		return fmt.Errorf("dfq: commit: seek: %w", err)
+	}
+	size, err := readFrame(f)
+	if err == ErrCorruptRecord {
+		// The frame is whole but fails its CRC check: step over it by the
+		// length in its header, so Commit can skip a record Peek rejected.
+		var lengthBuf [frameLengthSize]byte
+		if _, rerr := f.ReadAt(lengthBuf[:], q.state.ReadPos); rerr == nil {
+			size, err = int64(frameOverhead)+int64(binary.BigEndian.Uint32(lengthBuf[:])), nil
+		}
+	}
+	if err != nil {
+		q.stateLock.Unlock()
+		return fmt.Errorf("dfq: commit: %w", err)
+	}
+
+	q.state.ReadPos += size
+	q.state.Depth--
+	finishedSegment := q.state.ReadFileNum < q.state.WriteFileNum && q.state.ReadPos >= segmentFileSize(f)
+	if finishedSegment {
+		old := q.state.ReadFileNum
+		_ = q.readFile.Close()
+		q.readFile = nil
+		q.state.ReadFileNum++
+		q.state.ReadPos = 0
+		if q.state.LowestFileNum == old {
+			q.state.LowestFileNum = q.state.ReadFileNum
+		}
+		err = q.saveState()
+		q.stateLock.Unlock()
+		if err != nil {
+			return fmt.Errorf("dfq: commit: save state: %w", err)
+		}
+		if rmErr := os.Remove(q.segmentPath(old)); rmErr != nil && !os.IsNotExist(rmErr) {
+			return fmt.Errorf("dfq: commit: remove consumed segment: %w", rmErr)
+		}
+		q.notifyUpdate()
+		return nil
+	}
+	err = q.saveState()
+	q.stateLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("dfq: commit: save state: %w", err)
+	}
+	q.notifyUpdate()
+	return nil
+}
+
+func (q *segmentedQueue) ensureInflight() (*inflightTracker, error) {
+	q.inflightOnce.Do(func() {
+		q.inflight, q.inflightErr = newInflightTracker(filepath.Join(q.directory, inflightFile), q.onExpire)
+	})
+	return q.inflight, q.inflightErr
+}
+
+// Reserve peeks the oldest record like Peek, but advances the read cursor so
+// the next Reserve/Peek sees the following record. The caller must Ack or
+// Nack the returned Message; an unresolved reservation is automatically
+// redelivered once timeout elapses, ahead of records not yet reserved and
+// without rewinding the read cursor (see onExpire). Segments are only deleted once fully consumed *and*
+// nothing is still reserved out of them (see tryCompact). Reserve should not
+// be mixed with Peek/Commit on the same queue.
+func (q *segmentedQueue) Reserve(ctx context.Context, timeout time.Duration) (Message, error) {
+	tracker, err := q.ensureInflight()
+	if err != nil {
+		return nil, fmt.Errorf("dfq: reserve: %w", err)
+	}
+	for {
+		msg, err := q.tryReserve(tracker, timeout)
+		if err != ErrEmptyQueue {
+			return msg, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.notify:
+		}
+	}
+}
+
+func (q *segmentedQueue) tryReserve(tracker *inflightTracker, timeout time.Duration) (Message, error) {
+	q.readLock.Lock()
+	defer q.readLock.Unlock()
+
+	if id, ok := q.popRedeliver(); ok {
+		fileNum, pos := decodeID(id)
+		payload, err := q.readRecordAt(fileNum, pos)
+		if err != nil {
+			return nil, fmt.Errorf("dfq: reserve: redeliver: %w", err)
+		}
+		if _, err := tracker.begin(id, timeout, map[string]int64{"file": fileNum}); err != nil {
+			return nil, fmt.Errorf("dfq: reserve: %w", err)
+		}
+		return &segmentMessage{queue: q, id: id, payload: bytes.NewReader(payload)}, nil
+	}
+
+	q.stateLock.Lock()
+	readFileNum, readPos, writeFileNum, writePos := q.state.ReadFileNum, q.state.ReadPos, q.state.WriteFileNum, q.state.WritePos
+	q.stateLock.Unlock()
+	if readFileNum == writeFileNum && readPos >= writePos {
+		return nil, ErrEmptyQueue
+	}
+
+	if q.readFile == nil {
+		f, err := os.Open(q.segmentPath(readFileNum))
+		if err != nil {
+			return nil, fmt.Errorf("dfq: reserve: open segment: %w", err)
+		}
+		q.readFile = f
+	}
+	if _, err := q.readFile.Seek(readPos, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("dfq: reserve: seek: %w", err)
+	}
+
+	var lengthBuf [frameLengthSize]byte
+	if _, err := io.ReadFull(q.readFile, lengthBuf[:]); err != nil {
+		return nil, fmt.Errorf("dfq: reserve: read length: %w", ErrCorruptRecord)
+	}
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(q.readFile, payload); err != nil {
+		return nil, fmt.Errorf("dfq: reserve: read payload: %w", ErrCorruptRecord)
+	}
+	var crcBuf [frameCrcSize]byte
+	if _, err := io.ReadFull(q.readFile, crcBuf[:]); err != nil {
+		return nil, fmt.Errorf("dfq: reserve: read crc: %w", ErrCorruptRecord)
+	}
+	if binary.BigEndian.Uint32(crcBuf[:]) != crc32.ChecksumIEEE(payload) {
+		return nil, fmt.Errorf("dfq: reserve: frame %d@%d: %w", readFileNum, readPos, ErrCorruptRecord)
+	}
+
+	id := encodeID(readFileNum, readPos)
+	newPos := readPos + int64(frameOverhead+len(payload))
+	newFileNum := readFileNum
+	if readFileNum < writeFileNum && newPos >= segmentFileSize(q.readFile) {
+		_ = q.readFile.Close()
+		q.readFile = nil
+		newFileNum = readFileNum + 1
+		newPos = 0
+	}
+
+	q.stateLock.Lock()
+	q.state.ReadFileNum = newFileNum
+	q.state.ReadPos = newPos
+	err := q.saveState()
+	q.stateLock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("dfq: reserve: save state: %w", err)
+	}
+	if _, err := tracker.begin(id, timeout, map[string]int64{"file": readFileNum}); err != nil {
+		return nil, fmt.Errorf("dfq: reserve: %w", err)
+	}
+	return &segmentMessage{queue: q, id: id, payload: bytes.NewReader(payload)}, nil
+}
+
+// popRedeliver removes and returns the lowest id queued for redelivery by
+// onExpire, if any. Lowest-first keeps redelivery order close to original
+// delivery order without needing a full priority queue for what is normally
+// a tiny, short-lived set.
+func (q *segmentedQueue) popRedeliver() (int64, bool) {
+	q.redeliver.lock.Lock()
+	defer q.redeliver.lock.Unlock()
+	var id int64
+	found := false
+	for candidate := range q.redeliver.ids {
+		if !found || candidate < id {
+			id, found = candidate, true
+		}
+	}
+	if found {
+		delete(q.redeliver.ids, id)
+	}
+	return id, found
+}
+
+// onExpire is invoked by the inflight tracker when a reservation's visibility
+// timeout elapses without an Ack/Nack. It either queues the item for
+// redelivery or, once the retry policy's MaxAttempts is exceeded, diverts it
+// to the dead letter queue. Redelivery never rewinds the read cursor: doing
+// so would also re-hand-out any later frame that was already validly
+// reserved (see popRedeliver/tryReserve).
+func (q *segmentedQueue) onExpire(id int64, attempts int, _ map[string]int64) {
+	q.retry.lock.Lock()
+	maxAttempts, deadLetter := q.retry.maxAttempts, q.retry.deadLetter
+	q.retry.lock.Unlock()
+
+	fileNum, pos := decodeID(id)
+
+	if maxAttempts > 0 && attempts >= maxAttempts {
+		if deadLetter != nil {
+			if payload, err := q.readRecordAt(fileNum, pos); err == nil {
+				_ = deadLetter.Put(bytes.NewReader(payload))
+			}
+		}
+		_ = q.inflight.ack(id)
+		q.stateLock.Lock()
+		q.state.Depth--
+		_ = q.saveState()
+		q.stateLock.Unlock()
+		q.tryCompact()
+		return
+	}
+
+	q.redeliver.lock.Lock()
+	if q.redeliver.ids == nil {
+		q.redeliver.ids = map[int64]struct{}{}
+	}
+	q.redeliver.ids[id] = struct{}{}
+	q.redeliver.lock.Unlock()
+	q.notifyUpdate()
+}
+
+func (q *segmentedQueue) readRecordAt(fileNum, pos int64) ([]byte, error) {
+	f, err := os.Open(q.segmentPath(fileNum))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var lengthBuf [frameLengthSize]byte
+	if _, err := io.ReadFull(f, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(lengthBuf[:]))
+	if _, err := io.ReadFull(f, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// tryCompact deletes segment files that are both behind the read cursor and
+// no longer referenced by any in-flight reservation.
+func (q *segmentedQueue) tryCompact() {
+	q.stateLock.Lock()
+	target := q.state.ReadFileNum
+	q.stateLock.Unlock()
+	if minFile, ok := q.inflight.minMeta("file"); ok && minFile < target {
+		target = minFile
+	}
+	q.stateLock.Lock()
+	defer q.stateLock.Unlock()
+	for q.state.LowestFileNum < target {
+		_ = os.Remove(q.segmentPath(q.state.LowestFileNum))
+		q.state.LowestFileNum++
+	}
+	_ = q.saveState()
+}
+
+// segmentMessage is the Message returned by segmentedQueue.Reserve.
+type segmentMessage struct {
+	queue   *segmentedQueue
+	id      int64
+	payload *bytes.Reader
+}
+
+func (m *segmentMessage) Read(p []byte) (int, error) { return m.payload.Read(p) }
+func (m *segmentMessage) Close() error               { return nil }
+
+// Ack commits the message: the reservation is forgotten and the record
+// becomes eligible for segment compaction.
+func (m *segmentMessage) Ack() error {
+	if err := m.queue.inflight.ack(m.id); err != nil {
+		return fmt.Errorf("dfq: ack: %w", err)
+	}
+	m.queue.stateLock.Lock()
+	m.queue.state.Depth--
+	err := m.queue.saveState()
+	m.queue.stateLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("dfq: ack: save state: %w", err)
+	}
+	m.queue.tryCompact()
+	return nil
+}
+
+// Nack returns the message for redelivery after delay. A delay of 0 makes it
+// available again immediately instead of waiting for the background sweep.
+func (m *segmentMessage) Nack(delay time.Duration) error {
+	if delay > 0 {
+		if err := m.queue.inflight.requeue(m.id, delay); err != nil {
+			return fmt.Errorf("dfq: nack: %w", err)
+		}
+		return nil
+	}
+	if attempts, meta, ok := m.queue.inflight.force(m.id); ok {
+		m.queue.onExpire(m.id, attempts, meta)
+	}
+	return nil
+}
+
+func segmentFileSize(f *os.File) int64 {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Wait peeks the oldest record, blocking until one is available or ctx is done.
+func (q *segmentedQueue) Wait(ctx context.Context) (io.ReadCloser, error) {
+	for {
+		f, err := q.Peek()
+		if err == nil {
+			return f, nil
+		}
+		if err != ErrEmptyQueue {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.notify:
+		}
+	}
+}
+
+func (q *segmentedQueue) Len() int64 {
+	q.stateLock.Lock()
+	defer q.stateLock.Unlock()
+	return q.state.Depth
+}
+
+// Destroy removes everything in the queue directory (and the directory itself).
+func (q *segmentedQueue) Destroy() error {
+	if q.inflight != nil {
+		q.inflight.close()
+	}
+	q.writeLock.Lock()
+	if q.writeFile != nil {
+		_ = q.writeFile.Close()
+	}
+	q.writeLock.Unlock()
+	q.readLock.Lock()
+	if q.readFile != nil {
+		_ = q.readFile.Close()
+	}
+	q.readLock.Unlock()
+	return os.RemoveAll(q.directory)
+}
+
+func (q *segmentedQueue) notifyUpdate() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
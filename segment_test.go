@@ -0,0 +1,277 @@
+package dfq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOpenWithOptions(t *testing.T) {
+	q, err := OpenWithOptions("./test/segmented", Options{MaxBytesPerFile: 64})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("var1")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("var2")); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 2 {
+		t.Error("queue size should be 2")
+		return
+	}
+
+	s, err := GetString(q)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s != "var1" {
+		t.Error("corrupted")
+		return
+	}
+	if err := q.Commit(); err != nil {
+		t.Error(err)
+		return
+	}
+	s, err = GetString(q)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s != "var2" {
+		t.Error("corrupted")
+		return
+	}
+	if err := q.Commit(); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 0 {
+		t.Error("queue size should be 0")
+	}
+}
+
+func TestSegmentedQueue_ReserveAckNack(t *testing.T) {
+	q, err := OpenWithOptions("./test/segmented-reserve", Options{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("s1")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("s2")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	msg, err := q.Reserve(ctx, 1*time.Second)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "s1" {
+		t.Error("corrupted")
+		return
+	}
+
+	// returning it immediately should make it the next thing redelivered,
+	// ahead of the still-unread s2
+	if err := msg.Nack(0); err != nil {
+		t.Error(err)
+		return
+	}
+	redelivered, err := q.Reserve(ctx, 1*time.Second)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err = ioutil.ReadAll(redelivered)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "s1" {
+		t.Error("expected redelivery of nacked message ahead of s2")
+		return
+	}
+	if err := redelivered.Ack(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	msg2, err := q.Reserve(ctx, 1*time.Second)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err = ioutil.ReadAll(msg2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "s2" {
+		t.Error("corrupted")
+		return
+	}
+	if err := msg2.Ack(); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 0 {
+		t.Error("queue should be empty after both Acks")
+	}
+}
+
+// TestSegmentedQueue_ReserveExpiryDoesNotDuplicateLaterReservation guards
+// against redelivery rewinding the shared read cursor behind a still validly
+// reserved later frame, which would hand that frame out a second time.
+func TestSegmentedQueue_ReserveExpiryDoesNotDuplicateLaterReservation(t *testing.T) {
+	q, err := OpenWithOptions("./test/segmented-reserve-expiry-order", Options{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("s1")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("s2")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if _, err := q.Reserve(ctx, 200*time.Millisecond); err != nil { // s1, short timeout
+		t.Error(err)
+		return
+	}
+	msg2, err := q.Reserve(ctx, 2*time.Second) // s2, long timeout
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(500 * time.Millisecond) // past s1's timeout, well within s2's
+
+	redelivered, err := q.Reserve(ctx, time.Second)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := ioutil.ReadAll(redelivered)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "s1" {
+		t.Errorf("expected redelivery of expired item 's1', got %q", data)
+	}
+	if err := redelivered.Ack(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// s2 is still validly reserved: there is nothing else to deliver, so
+	// Reserve must block instead of handing s2 out a second time.
+	ctxShort, cancelShort := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelShort()
+	if _, err := q.Reserve(ctxShort, time.Second); err != context.DeadlineExceeded {
+		t.Errorf("expected Reserve to block while s2 is still reserved, got %v", err)
+	}
+
+	if err := msg2.Ack(); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.Len() != 0 {
+		t.Error("queue should be empty after both Acks")
+	}
+}
+
+func TestOpenWithOptions_VerifyOnOpen(t *testing.T) {
+	const dir = "./test/segmented-verify"
+	defer os.RemoveAll(dir)
+
+	// MaxBytesPerFile is tight enough that each Put below rolls into its own
+	// segment, so the corruption we introduce lands in an older, already
+	// rolled-over segment rather than the write-segment tail that recoverTail
+	// handles on every Open regardless of VerifyOnOpen.
+	q, err := OpenWithOptions(dir, Options{MaxBytesPerFile: 12})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("good")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("broken")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("tail")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// flip a payload byte of the "broken" frame, which now lives alone in its
+	// own already-rolled segment.
+	segment := q.segmentPath(1)
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[frameLengthSize] ^= 0xFF
+	if err := ioutil.WriteFile(segment, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenWithOptions(dir, Options{VerifyOnOpen: true}); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected ErrCorruptRecord, got %v", err)
+	}
+
+	q2, err := OpenWithOptions(dir, Options{VerifyOnOpen: true, RepairMode: RepairTruncate})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q2.Destroy()
+	if q2.Len() != 1 {
+		t.Errorf("expected only the healthy record to remain, got depth %d", q2.Len())
+	}
+	s, err := GetString(q2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s != "good" {
+		t.Errorf("unexpected surviving record: %q", s)
+	}
+}
@@ -0,0 +1,261 @@
+package dfq
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	recordMagic   = "DFQ1"
+	recordVersion = 1
+	// headerSize is [magic:4][version:1][crc32:4][size:8].
+	headerSize = 4 + 1 + 4 + 8
+)
+
+// VerifyEvent reports the outcome of validating one record during an online
+// scrub started by Verify. Err is nil if the record is healthy.
+type VerifyEvent struct {
+	ID  int64
+	Err error
+}
+
+func encodeHeader(crc uint32, size int64) []byte {
+	b := make([]byte, headerSize)
+	copy(b[0:4], recordMagic)
+	b[4] = recordVersion
+	binary.BigEndian.PutUint32(b[5:9], crc)
+	binary.BigEndian.PutUint64(b[9:17], uint64(size))
+	return b
+}
+
+func decodeHeader(b []byte) (crc uint32, size int64, err error) {
+	if len(b) < headerSize || string(b[0:4]) != recordMagic {
+		return 0, 0, fmt.Errorf("bad magic")
+	}
+	if b[4] != recordVersion {
+		return 0, 0, fmt.Errorf("unsupported record version %d", b[4])
+	}
+	crc = binary.BigEndian.Uint32(b[5:9])
+	size = int64(binary.BigEndian.Uint64(b[9:17]))
+	return crc, size, nil
+}
+
+// byteCounter is an io.Writer that only counts bytes written through it.
+type byteCounter struct{ n int64 }
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// readRecord opens a classic-backend data file, validates its
+// [magic][version][crc32][size] header and checksum, and returns the
+// payload. A missing file surfaces as the original *PathError (so callers
+// can still use os.IsNotExist), while a short or checksum-mismatched file is
+// wrapped in ErrCorruptRecord.
+func readRecord(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("dfq: read record %s: %w", filepath.Base(path), ErrCorruptRecord)
+	}
+	crc, size, err := decodeHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("dfq: read record %s: %s: %w", filepath.Base(path), err, ErrCorruptRecord)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(f, payload); err != nil {
+		return nil, fmt.Errorf("dfq: read record %s: %w", filepath.Base(path), ErrCorruptRecord)
+	}
+	if crc32.ChecksumIEEE(payload) != crc {
+		return nil, fmt.Errorf("dfq: read record %s: %w", filepath.Base(path), ErrCorruptRecord)
+	}
+	return payload, nil
+}
+
+// recordStream is the io.ReadCloser returned by openRecordStream: it streams
+// a record's payload straight from the open file instead of buffering it,
+// checking the running CRC32 against the header once the last payload byte
+// has been read. A corrupt payload therefore surfaces as ErrCorruptRecord
+// from the Read call that drains it, not from openRecordStream itself.
+type recordStream struct {
+	file    *os.File
+	path    string
+	remain  int64
+	wantCRC uint32
+	hash    hash.Hash32
+}
+
+// openRecordStream opens a classic-backend data file and validates its
+// [magic][version][crc32][size] header, same as readRecord, but returns a
+// stream over the payload instead of reading it fully into memory. A missing
+// file surfaces as the original *PathError (so callers can still use
+// os.IsNotExist); a corrupt header does the same via ErrCorruptRecord.
+func openRecordStream(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("dfq: read record %s: %w", filepath.Base(path), ErrCorruptRecord)
+	}
+	crc, size, err := decodeHeader(header)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("dfq: read record %s: %s: %w", filepath.Base(path), err, ErrCorruptRecord)
+	}
+	return &recordStream{file: f, path: path, remain: size, wantCRC: crc, hash: crc32.NewIEEE()}, nil
+}
+
+func (r *recordStream) Read(p []byte) (int, error) {
+	if r.remain <= 0 {
+		return 0, r.verify()
+	}
+	if int64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	n, err := r.file.Read(p)
+	if n > 0 {
+		r.hash.Write(p[:n])
+		r.remain -= int64(n)
+	}
+	switch {
+	case err == io.EOF && r.remain > 0:
+		return n, fmt.Errorf("dfq: read record %s: %w", filepath.Base(r.path), ErrCorruptRecord)
+	case err != nil:
+		return n, err
+	case r.remain == 0:
+		if verr := r.verify(); verr != nil {
+			return n, verr
+		}
+		return n, io.EOF
+	default:
+		return n, nil
+	}
+}
+
+func (r *recordStream) verify() error {
+	if r.hash.Sum32() != r.wantCRC {
+		return fmt.Errorf("dfq: read record %s: %w", filepath.Base(r.path), ErrCorruptRecord)
+	}
+	return io.EOF
+}
+
+func (r *recordStream) Close() error {
+	return r.file.Close()
+}
+
+// recordPayloadSize reads just the header of a classic-backend data file
+// (not the payload itself) and returns the record's payload size, as used by
+// MaxBytes accounting. Like readRecord, a missing file surfaces as the
+// original *PathError.
+func recordPayloadSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("dfq: read record %s: %w", filepath.Base(path), ErrCorruptRecord)
+	}
+	_, size, err := decodeHeader(header)
+	if err != nil {
+		return 0, fmt.Errorf("dfq: read record %s: %s: %w", filepath.Base(path), err, ErrCorruptRecord)
+	}
+	return size, nil
+}
+
+// verifyAndRepair validates every data file in the queue directory. Under
+// RepairStrict it returns an error listing the corrupt ids; otherwise
+// (RepairSkipCorrupt or RepairTruncate -- equivalent here, since a corrupt
+// classic-backend record has no "rest of the file" to truncate) it moves
+// each corrupt file into a corrupt/ subdirectory, leaving a gap that Peek and
+// Reserve transparently skip over (they are what keeps Len accurate, so
+// quarantining here does not itself touch q.length).
+func (q *queue) verifyAndRepair(mode RepairMode) error {
+	list, err := ioutil.ReadDir(q.directory)
+	if err != nil {
+		return err
+	}
+	var corrupt []int64
+	for _, file := range list {
+		name := file.Name()
+		if !strings.HasSuffix(name, dataSuffix) {
+			continue
+		}
+		id, err := strconv.ParseInt(name[:len(name)-len(dataSuffix)], 10, 64)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(q.directory, name)
+		if _, verr := readRecord(path); verr != nil {
+			corrupt = append(corrupt, id)
+			if mode != RepairStrict {
+				if err := q.quarantine(path, name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if mode == RepairStrict && len(corrupt) > 0 {
+		return fmt.Errorf("dfq: open: %d corrupt record(s) %v: %w", len(corrupt), corrupt, ErrCorruptRecord)
+	}
+	return nil
+}
+
+func (q *queue) quarantine(path, name string) error {
+	dir := filepath.Join(q.directory, "corrupt")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(dir, name))
+}
+
+// Verify scans every record currently in the queue and reports its status on
+// the returned channel, which is closed once the scan finishes or ctx is
+// done. Unlike VerifyOnOpen, it does not repair anything.
+func (q *queue) Verify(ctx context.Context) (<-chan VerifyEvent, error) {
+	list, err := ioutil.ReadDir(q.directory)
+	if err != nil {
+		return nil, fmt.Errorf("dfq: verify: %w", err)
+	}
+	events := make(chan VerifyEvent)
+	go func() {
+		defer close(events)
+		for _, file := range list {
+			name := file.Name()
+			if !strings.HasSuffix(name, dataSuffix) {
+				continue
+			}
+			id, err := strconv.ParseInt(name[:len(name)-len(dataSuffix)], 10, 64)
+			if err != nil {
+				continue
+			}
+			_, verr := readRecord(filepath.Join(q.directory, name))
+			select {
+			case events <- VerifyEvent{ID: id, Err: verr}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
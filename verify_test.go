@@ -0,0 +1,187 @@
+package dfq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueue_VerifyOnOpen_Strict(t *testing.T) {
+	const dir = "./test/verify-strict"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("hello")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	corruptFile(t, filepath.Join(dir, "0.data"))
+
+	if _, err := Open(dir, Options{VerifyOnOpen: true}); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected ErrCorruptRecord, got %v", err)
+	}
+}
+
+func TestQueue_VerifyOnOpen_SkipCorrupt(t *testing.T) {
+	const dir = "./test/verify-skip"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("good1")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("bad")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("good2")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	corruptFile(t, filepath.Join(dir, "1.data"))
+
+	q2, err := Open(dir, Options{VerifyOnOpen: true, RepairMode: RepairSkipCorrupt})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q2.Destroy()
+
+	if _, err := os.Stat(filepath.Join(dir, "corrupt", "1.data")); err != nil {
+		t.Errorf("corrupt record should have been quarantined: %v", err)
+	}
+
+	s, err := GetString(q2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s != "good1" {
+		t.Errorf("unexpected first record: %q", s)
+	}
+	if err := q2.Commit(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the corrupt record in between should be skipped transparently
+	s, err = GetString(q2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s != "good2" {
+		t.Errorf("expected corrupt record to be skipped, got %q", s)
+	}
+	if err := q2.Commit(); err != nil {
+		t.Error(err)
+		return
+	}
+	if q2.Len() != 0 {
+		t.Error("queue should be empty after committing both good records")
+	}
+}
+
+func TestQueue_Verify(t *testing.T) {
+	const dir = "./test/verify-scan"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("fine")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := q.Put(bytes.NewBufferString("also broken")); err != nil {
+		t.Error(err)
+		return
+	}
+	corruptFile(t, filepath.Join(dir, "1.data"))
+
+	events, err := q.Verify(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var healthy, corrupt int
+	for ev := range events {
+		if ev.Err != nil {
+			corrupt++
+		} else {
+			healthy++
+		}
+	}
+	if healthy != 1 || corrupt != 1 {
+		t.Errorf("expected 1 healthy and 1 corrupt record, got healthy=%d corrupt=%d", healthy, corrupt)
+	}
+}
+
+// TestQueue_PeekDetectsCorruptionWhileStreaming guards against Peek going
+// back to buffering the whole payload in memory: it should hand back a
+// reader that streams straight off disk and only reports ErrCorruptRecord
+// once the caller has drained it, rather than eagerly failing inside Peek.
+func TestQueue_PeekDetectsCorruptionWhileStreaming(t *testing.T) {
+	const dir = "./test/verify-peek-stream"
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer q.Destroy()
+
+	if err := q.Put(bytes.NewBufferString("corrupt me")); err != nil {
+		t.Error(err)
+		return
+	}
+	corruptFile(t, filepath.Join(dir, "0.data"))
+
+	f, err := q.Peek()
+	if err != nil {
+		t.Errorf("Peek should not eagerly fail on a corrupt payload, got %v", err)
+		return
+	}
+	_, err = ioutil.ReadAll(f)
+	_ = f.Close()
+	if !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected ErrCorruptRecord from draining the stream, got %v", err)
+	}
+}
+
+// corruptFile flips a byte inside the payload region of a record file,
+// leaving its header intact so the CRC mismatch is what's detected.
+func corruptFile(t *testing.T, path string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) <= headerSize {
+		t.Fatalf("file %s too small to corrupt", path)
+	}
+	data[headerSize] ^= 0xFF
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}